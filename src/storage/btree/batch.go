@@ -0,0 +1,315 @@
+package btree
+
+import (
+	"sort"
+)
+
+// Batch collects Puts and Deletes to be applied to a tree as a whole
+type Batch struct {
+	ops []batchOp
+}
+
+// a single update of a batch
+type batchOp struct {
+	key []byte
+	val []byte
+	del bool
+}
+
+// insert or update a key, the key and the value are copied
+func (b *Batch) Put(key []byte, val []byte) {
+	b.ops = append(b.ops, batchOp{
+		key: append([]byte{}, key...), val: append([]byte{}, val...),
+	})
+}
+
+// delete a key, deleting a missing key is not an error
+func (b *Batch) Delete(key []byte) {
+	b.ops = append(b.ops, batchOp{key: append([]byte{}, key...), del: true})
+}
+
+// the number of updates in the batch
+func (b *Batch) Len() int {
+	return len(b.ops)
+}
+
+// remove every update, so that the batch can be reused
+func (b *Batch) Reset() {
+	b.ops = b.ops[:0]
+}
+
+// the pages touched by applying a batch
+type batchTx struct {
+	tree      *BTree
+	freed     []uint64    // replaced pages, deallocated after the root is updated
+	allocated []uint64    // new pages, deallocated if the batch fails
+	slotted   slottedLeaf // reused for the leaves updated in place
+}
+
+// allocate a page for a new node
+func (tx *batchTx) new(node BNode) uint64 {
+	ptr := tx.tree.newNode(node)
+	tx.allocated = append(tx.allocated, ptr)
+	return ptr
+}
+
+// write the stored form of a new key and track its overflow pages
+func (tx *batchTx) storeKey(key []byte) ([]byte, uint16) {
+	stored, kflag := tx.tree.storeKey(key)
+	if kflag != 0 {
+		ref := stored[tx.tree.keyPrefixSize():]
+		tx.allocated = append(tx.allocated, tx.tree.overflowPages(ref)...)
+	}
+	return stored, kflag
+}
+
+// write the stored form of a value and track its overflow pages
+func (tx *batchTx) storeValue(val []byte) ([]byte, uint16) {
+	stored, vflag := tx.tree.storeValue(val)
+	if vflag != 0 {
+		tx.allocated = append(tx.allocated, tx.tree.overflowPages(stored)...)
+	}
+	return stored, vflag
+}
+
+// apply the updates of the batch in one pass.
+// each affected node is rewritten once and the root is switched at the end,
+// so a Snapshot taken by a concurrent reader sees either all of the batch or
+// none of it. the replaced pages are kept until the snapshots of the old
+// root are released. the tree is not changed if an error is returned.
+func (tree *BTree) Apply(b *Batch) error {
+	for _, op := range b.ops {
+		if err := checkKV(op.key, op.val); err != nil {
+			return err
+		}
+	}
+	if err := tree.checkWritable(); err != nil {
+		return err
+	}
+	ops := tree.sortOps(b.ops)
+
+	var root BNode
+	if tree.root == 0 {
+		// the empty tree is a leaf with only the sentinel key
+		root = BNode(make([]byte, tree.pageSize()))
+		root.setHeader(BNODE_LEAF, 1)
+		nodeAppendKV(root, 0, 0, nil, nil)
+	} else {
+		root = tree.get(tree.root)
+	}
+	tx := &batchTx{tree: tree}
+	entries, nodes, changed, err := treeApply(tx, root, ops)
+	if err != nil {
+		tree.freePages(tx.allocated)
+		tree.publish(tree.root) // the new pages are not in any root
+		return err
+	}
+	if !changed {
+		return nil
+	}
+	if tree.root != 0 {
+		tx.freed = append(tx.freed, tree.root)
+	}
+
+	// add levels until a single node is left
+	btype := root.btype()
+	if len(nodes) > 0 {
+		entries, btype = tree.linkKids(nodes, tx.new), BNODE_NODE
+	}
+	for len(entries) > 1 || btype == BNODE_LEAF {
+		entries = tree.linkKids(tree.packNodes(btype, entries), tx.new)
+		btype = BNODE_NODE
+	}
+	// drop the levels that are left with a single kid
+	ptr := entries[0].ptr
+	for node := tree.get(ptr); node.btype() == BNODE_NODE && node.nkeys() == 1; node = tree.get(ptr) {
+		tx.freed = append(tx.freed, ptr)
+		ptr = node.getPtr(0)
+	}
+
+	tree.freePages(tx.freed)
+	tree.publish(ptr)
+	return nil
+}
+
+// sort the updates by key, only the last update of a key is kept
+func (tree *BTree) sortOps(ops []batchOp) []batchOp {
+	sorted := append([]batchOp{}, ops...)
+	sort.SliceStable(sorted, func(i, j int) bool {
+		return tree.compare(sorted[i].key, sorted[j].key) < 0
+	})
+	out := sorted[:0]
+	for _, op := range sorted {
+		if len(out) > 0 && tree.compare(out[len(out)-1].key, op.key) == 0 {
+			out[len(out)-1] = op
+		} else {
+			out = append(out, op)
+		}
+	}
+	return out
+}
+
+// apply the sorted updates to a subtree, returns what replaces the node and
+// whether anything was changed. a leaf updated in place is replaced by
+// finished nodes that fit into a page, otherwise it's the entries, which
+// might not fit into a single page, or there might be none.
+func treeApply(tx *batchTx, node BNode, ops []batchOp) ([]kvEntry, []BNode, bool, error) {
+	if err := checkNode(node); err != nil {
+		return nil, nil, false, err
+	}
+	if node.btype() == BNODE_NODE {
+		entries, changed, err := nodeApply(tx, node, ops)
+		return entries, nil, changed, err
+	}
+	if nodes, changed, ok := leafApplyInPlace(tx, node, ops); ok {
+		return nil, nodes, changed, nil
+	}
+	entries, changed := leafApply(tx, node, ops)
+	return entries, nil, changed, nil
+}
+
+// merge the updates with the KVs of a leaf
+func leafApply(tx *batchTx, node BNode, ops []batchOp) ([]kvEntry, bool) {
+	tree := tx.tree
+	nkeys := node.nkeys()
+	entries := make([]kvEntry, 0, int(nkeys)+len(ops))
+	changed := false
+	i := uint16(0)
+	for _, op := range ops {
+		// the KVs before the key are kept
+		cmp := -1
+		for ; i < nkeys; i++ {
+			if cmp = tree.compareKey(node, i, op.key); cmp >= 0 {
+				break
+			}
+			entries = append(entries, nodeEntry(node, i))
+		}
+		found := i < nkeys && cmp == 0
+		switch {
+		case found && op.del:
+			tx.freed = append(tx.freed, tree.kvPages(node, i)...)
+			i++
+		case found:
+			// keep the stored key, replace the value
+			tx.freed = append(tx.freed, tree.valuePages(node, i)...)
+			val, vflag := tx.storeValue(op.val)
+			entries = append(entries, kvEntry{
+				key: node.getKey(i), kflag: node.keyFlag(i), val: val, vflag: vflag,
+			})
+			i++
+		case op.del:
+			continue // deleting a missing key
+		default:
+			key, kflag := tx.storeKey(op.key)
+			val, vflag := tx.storeValue(op.val)
+			entries = append(entries, kvEntry{key: key, val: val, kflag: kflag, vflag: vflag})
+		}
+		changed = true
+	}
+	for ; i < nkeys; i++ {
+		entries = append(entries, nodeEntry(node, i))
+	}
+	return entries, changed
+}
+
+// route the updates to the kids, then relink the node.
+// consecutive updated kids are repacked together, and a small result
+// takes in an unchanged sibling so that deletes don't leave tiny nodes.
+func nodeApply(tx *batchTx, node BNode, ops []batchOp) ([]kvEntry, bool, error) {
+	tree := tx.tree
+	nkeys := node.nkeys()
+	entries := make([]kvEntry, 0, nkeys)
+	var run []kvEntry // the entries of the updated kids not yet packed
+	// inRun is whether there are updated kids to pack,
+	// kept is whether the last entry is an unchanged kid
+	changed, inRun, kept := false, false, false
+	// repack the updated kids
+	flush := func(btype uint16) {
+		if runSize(run) < tree.minFill() && kept {
+			last := entries[len(entries)-1]
+			entries = entries[:len(entries)-1]
+			tx.freed = append(tx.freed, last.ptr)
+			run = append(nodeEntries(tree.get(last.ptr)), run...)
+		}
+		entries = append(entries, tree.linkKids(tree.packNodes(btype, run), tx.new)...)
+		run, inRun, kept = nil, false, false
+	}
+
+	var btype uint16
+	for i := uint16(0); i < nkeys; i++ {
+		// the updates below the next separator go to this kid
+		n := len(ops)
+		if i+1 < nkeys {
+			n = sort.Search(len(ops), func(j int) bool {
+				return tree.compareKey(node, i+1, ops[j].key) <= 0
+			})
+		}
+		kops := ops[:n]
+		ops = ops[n:]
+
+		kptr := node.getPtr(i)
+		var kid []kvEntry
+		var done []BNode
+		updated := false
+		if len(kops) > 0 {
+			knode := tree.get(kptr)
+			var err error
+			if kid, done, updated, err = treeApply(tx, knode, kops); err != nil {
+				return nil, false, err
+			}
+			btype = knode.btype()
+		}
+		if len(done) == 1 && done[0].rawBytes() < tree.minFill() {
+			// a small leaf is repacked with its neighbours
+			kid, done = nodeEntries(done[0]), nil
+		}
+		switch {
+		case len(done) > 0:
+			// the finished leaves are linked as they are
+			tx.freed = append(tx.freed, kptr)
+			if inRun {
+				flush(btype)
+			}
+			entries = append(entries, tree.linkKids(done, tx.new)...)
+			changed, kept = true, false
+		case updated:
+			tx.freed = append(tx.freed, kptr)
+			run = append(run, kid...)
+			changed, inRun = true, true
+		case inRun && runSize(run) < tree.minFill():
+			// the small run takes in the unchanged kid
+			knode := tree.get(kptr)
+			tx.freed = append(tx.freed, kptr)
+			run = append(run, nodeEntries(knode)...)
+			flush(knode.btype())
+		default:
+			if inRun {
+				flush(btype)
+			}
+			entries = append(entries, nodeEntry(node, i))
+			kept = true
+		}
+	}
+	if inRun {
+		flush(btype)
+	}
+	return entries, changed, nil
+}
+
+// the total size of the entries
+func runSize(entries []kvEntry) int {
+	size := 0
+	for _, e := range entries {
+		size += e.size()
+	}
+	return size
+}
+
+// every KV of the node
+func nodeEntries(node BNode) []kvEntry {
+	entries := make([]kvEntry, node.nkeys())
+	for i := range entries {
+		entries[i] = nodeEntry(node, uint16(i))
+	}
+	return entries
+}
@@ -1,21 +1,34 @@
 package btree
 
 import (
+	"bytes"
 	"encoding/binary"
+	"fmt"
 
 	"github.com/harish876/scratchdb/src/utils"
 )
 
 const HEADER = 4
 
+// the default page size and its inline key and value limits,
+// the limits of a larger page are scaled with it, see Options
 const BTREE_PAGE_SIZE = 4096
-const BTREE_MAX_KEY_SIZE = 1000
-const BTREE_MAX_VAL_SIZE = 3000
+const BTREE_MAX_KEY_SIZE = 1000 // larger keys keep a prefix inline and the tail in overflow pages
+const BTREE_MAX_VAL_SIZE = 3000 // larger values are moved to overflow pages
+const BTREE_MAX_OVERFLOW_SIZE = 1 << 24
 const (
-	BNODE_NODE = 1
-	BNODE_LEAF = 2
+	BNODE_NODE     = 1
+	BNODE_LEAF     = 2
+	BNODE_OVERFLOW = 3 // a page of a large value
 )
 
+// a flag in the type field for the node format with a shared key prefix
+const BNODE_PREFIX = 0x100
+
+// the high bit of the klen or vlen field marks a key or value stored in
+// overflow pages, the inline bytes are then a reference to the overflow chain.
+const BTREE_LEN_OVERFLOW = 0x8000
+
 /*
 		### Node Structure
 
@@ -27,6 +40,38 @@ const (
 		|------|------|-----|-----|
 		|  2B  |  2B  | ... | ... |
 
+		A large value is moved to a chain of overflow pages, the leaf only
+		keeps a reference to it, and vlen has the BTREE_LEN_OVERFLOW bit set.
+
+		| type | unused | next | data |     | vlen | total len | first page |
+		|------|--------|------|------|     |------|-----------|------------|
+		|  2B  |   2B   |  8B  | ...  |     |  2B  |    4B     |     8B     |
+
+		A large key keeps its first keyPrefixSize() bytes inline for ordering,
+		followed by a reference to the rest of the key in overflow pages.
+		The overflow pages are owned by the leaf, separator keys in internal
+		nodes share them and are always refreshed from the kid's first key.
+
+		| klen | prefix | tail len | first page |
+		|------|--------|----------|------------|
+		|  2B  |  ...   |    4B    |     8B     |
+
+		The value of a kid link in an internal node is the number of keys in
+		the kid's subtree as an 8-byte integer, the sentinel key not counted.
+
+		With PrefixCompression, a node stores the prefix shared by all its keys
+		once after the header, marked by BNODE_PREFIX in the type field. The
+		keys in the KV area are the rest of the stored keys. The separators
+		that follow a leaf might be truncated to the shortest distinguishing
+		prefix of the kid's first key.
+
+		| type | nkeys | plen | prefix | pointers | offsets | key-values |
+		|------|-------|------|--------|----------|---------|------------|
+		|  2B  |   2B  |  2B  |  ...   |    ...   |   ...   |    ...     |
+
+		The offsets are 2 bytes, except for the temporary nodes of a tree
+		with 64K pages that are bigger than 64K, which use 4-byte offsets.
+
 
 		+----------------+----------------+----------------+----------------+----------------+--------+
 		|      type      |      nkeys     |    pointers    |    offsets     |  key-values    | unused |
@@ -44,25 +89,116 @@ const (
 	    and so on.
 */
 
-func init() {
-	node1max := HEADER + 8 + 2 + 4 + BTREE_MAX_KEY_SIZE + BTREE_MAX_VAL_SIZE
-	utils.Assert(node1max <= BTREE_PAGE_SIZE)
-}
-
 type BNode []byte
 
 type BTree struct {
 	//pointer  ( a non zero page number)
 	root uint64
 
-	//callback functions to manage on-disk storage
-	get func(uint64) BNode  //get reads a page from disk.
-	new func([]byte) uint64 //new allocates and writes a new page (copy-on-write).
-	del func(uint64)        //del deallocates a page.
+	//page size and size limits
+	cfg config
+
+	//the on-disk storage of the pages
+	store PageStore
+
+	//the snapshots of the roots, and the root of a snapshot
+	readers *readers
+	pin     *version
+
+	//the pages replaced by the update in progress
+	freed []uint64
+}
+
+// PageStore is the storage of the pages of a tree.
+// Get can be called by the readers of snapshots while the tree is updated.
+type PageStore interface {
+	// read a page, the page must not be modified
+	Get(ptr uint64) []byte
+	// write a new page of the page size and return its non-zero page number.
+	// pages are never updated in place (copy-on-write).
+	Allocate(page []byte) uint64
+	// deallocate a page
+	Free(ptr uint64)
+	// whether updates are rejected with ErrReadOnly
+	ReadOnly() bool
+}
+
+// create an empty tree on top of a page store
+func New(store PageStore, opts ...Options) (*BTree, error) {
+	if store == nil {
+		return nil, fmt.Errorf("%w: no page store", ErrInvalidOptions)
+	}
+	cfg, err := newConfig(append(opts, Options{})[0])
+	if err != nil {
+		return nil, err
+	}
+	return &BTree{cfg: cfg, store: store, readers: &readers{}}, nil
+}
+
+// open an existing tree on a page store, from the page number of its root.
+// the options must be the ones the tree is created with.
+func Open(store PageStore, root uint64, opts ...Options) (*BTree, error) {
+	tree, err := New(store, opts...)
+	if err != nil {
+		return nil, err
+	}
+	tree.root = root
+	return tree, nil
+}
+
+// the page number of the root, 0 for an empty tree.
+// it changes with every update, it's what a store persists to reopen the tree.
+func (tree *BTree) Root() uint64 {
+	return tree.root
+}
+
+// read a page from the store
+func (tree *BTree) get(ptr uint64) BNode {
+	return BNode(tree.store.Get(ptr))
+}
+
+// allocate and write a new page (copy-on-write)
+func (tree *BTree) new(page []byte) uint64 {
+	return tree.store.Allocate(page)
+}
+
+// deallocate a page once the update is published, see publish
+func (tree *BTree) del(ptr uint64) {
+	tree.freed = append(tree.freed, ptr)
+}
+
+// updates fail on a read-only store or a snapshot
+func (tree *BTree) checkWritable() error {
+	if tree.store.ReadOnly() || tree.pin != nil {
+		return ErrReadOnly
+	}
+	return nil
 }
 
 func (node BNode) btype() uint16 {
-	return binary.LittleEndian.Uint16(node[0:2])
+	return binary.LittleEndian.Uint16(node[0:2]) &^ BNODE_PREFIX
+}
+
+// whether the node is in the format with a shared key prefix
+func (node BNode) hasPrefix() bool {
+	return binary.LittleEndian.Uint16(node[0:2])&BNODE_PREFIX != 0
+}
+
+// the prefix shared by all keys of the node
+func (node BNode) prefix() []byte {
+	if !node.hasPrefix() {
+		return nil
+	}
+	plen := binary.LittleEndian.Uint16(node[HEADER:])
+	return node[HEADER+2:][:plen]
+}
+
+// the size of the header, including the shared key prefix
+func (node BNode) headerSize() int {
+	if !node.hasPrefix() {
+		return HEADER
+	}
+	return HEADER + 2 + len(node.prefix())
 }
 
 func (node BNode) nkeys() uint16 {
@@ -76,108 +212,305 @@ func (node BNode) setHeader(btype, nkeys uint16) {
 
 func (node BNode) getPtr(idx uint16) uint64 {
 	utils.Assert(idx < node.nkeys(), "Assert failed at getPtr")
-	pos := HEADER + idx*8
+	pos := node.headerSize() + int(idx)*8
 	return binary.LittleEndian.Uint64(node[pos:])
 }
 
 func (node BNode) setPtr(idx uint16, value uint64) {
 	utils.Assert(idx < node.nkeys())
-	pos := HEADER + idx*8
+	pos := node.headerSize() + int(idx)*8
 	binary.LittleEndian.PutUint64(node[pos:], value)
 }
 
-func offsetPos(node BNode, idx uint16) uint16 {
+// the width of an offset. a node bigger than 64K can only be a temporary
+// node of a tree with 64K pages, it needs 4-byte offsets to address it all.
+func (node BNode) offsetSize() int {
+	if len(node) > 1<<16 {
+		return 4
+	}
+	return 2
+}
+
+func offsetPos(node BNode, idx uint16) int {
 	utils.Assert(1 <= idx && idx <= node.nkeys(), "Assertion failed at offsetPos")
-	return HEADER + 8*(node.nkeys()) + 2*(idx-1)
+	return node.headerSize() + 8*int(node.nkeys()) + node.offsetSize()*int(idx-1)
 }
 
-func (node BNode) getOffset(idx uint16) uint16 {
+func (node BNode) getOffset(idx uint16) int {
 	if idx == 0 {
 		return 0
 	}
 	pos := offsetPos(node, idx)
-	return binary.LittleEndian.Uint16(node[pos:])
+	if node.offsetSize() == 4 {
+		return int(binary.LittleEndian.Uint32(node[pos:]))
+	}
+	return int(binary.LittleEndian.Uint16(node[pos:]))
 }
 
-func (node BNode) setOffset(idx, value uint16) {
+func (node BNode) setOffset(idx uint16, value int) {
 	pos := offsetPos(node, idx)
-	binary.LittleEndian.PutUint16(node[pos:], value)
+	if node.offsetSize() == 4 {
+		binary.LittleEndian.PutUint32(node[pos:], uint32(value))
+	} else {
+		binary.LittleEndian.PutUint16(node[pos:], uint16(value))
+	}
 }
 
-func (node BNode) kvPos(idx uint16) uint16 {
+func (node BNode) kvPos(idx uint16) int {
 	utils.Assert(idx <= node.nkeys())
-	return HEADER + 8*(node.nkeys()) + 2*node.nkeys() + node.getOffset(idx)
+	return node.headerSize() + (8+node.offsetSize())*int(node.nkeys()) + node.getOffset(idx)
 }
 
+// the inline bytes of the key, which end with a reference for an overflow key.
+// the shared prefix is prepended if the node has one.
 func (node BNode) getKey(idx uint16) []byte {
+	suffix := node.keySuffix(idx)
+	if prefix := node.prefix(); len(prefix) > 0 {
+		return append(append([]byte{}, prefix...), suffix...)
+	}
+	return suffix
+}
+
+// the key bytes in the KV area, without the shared prefix
+func (node BNode) keySuffix(idx uint16) []byte {
 	utils.Assert(idx < node.nkeys())
 	pos := node.kvPos(idx)
-	klen := binary.LittleEndian.Uint16(node[pos:])
+	klen := binary.LittleEndian.Uint16(node[pos:]) &^ BTREE_LEN_OVERFLOW
 	return node[pos+4:][:klen]
 }
 
+// the BTREE_LEN_OVERFLOW flag of the key
+func (node BNode) keyFlag(idx uint16) uint16 {
+	utils.Assert(idx < node.nkeys())
+	pos := node.kvPos(idx)
+	return binary.LittleEndian.Uint16(node[pos:]) & BTREE_LEN_OVERFLOW
+}
+
+// whether the key continues in overflow pages
+func (node BNode) isKeyRef(idx uint16) bool {
+	return node.keyFlag(idx) != 0
+}
+
+// the inline bytes of the value, which is a reference for an overflow value
 func (node BNode) getValue(idx uint16) []byte {
 	utils.Assert(idx < node.nkeys())
 	pos := node.kvPos(idx)
-	klen := binary.LittleEndian.Uint16(node[pos:])
-	vlen := binary.LittleEndian.Uint16(node[pos+2:])
-	return node[pos+4+klen:][:vlen]
+	klen := binary.LittleEndian.Uint16(node[pos:]) &^ BTREE_LEN_OVERFLOW
+	vlen := binary.LittleEndian.Uint16(node[pos+2:]) &^ BTREE_LEN_OVERFLOW
+	return node[pos+4+int(klen):][:vlen]
+}
+
+// the BTREE_LEN_OVERFLOW flag of the value
+func (node BNode) valueFlag(idx uint16) uint16 {
+	utils.Assert(idx < node.nkeys())
+	pos := node.kvPos(idx)
+	return binary.LittleEndian.Uint16(node[pos+2:]) & BTREE_LEN_OVERFLOW
+}
+
+// whether the value is stored in overflow pages
+func (node BNode) isValueRef(idx uint16) bool {
+	return node.valueFlag(idx) != 0
 }
 
-func (node BNode) nbytes() uint16 {
+func (node BNode) nbytes() int {
 	return node.kvPos(node.nkeys())
 }
 
+// the size of the node once it's stored in a page with 2-byte offsets
+func (node BNode) pageBytes() int {
+	return node.nbytes() - (node.offsetSize()-2)*int(node.nkeys())
+}
+
+// the size of the node without the shared prefix, with 2-byte offsets
+func (node BNode) rawBytes() int {
+	plen := len(node.prefix())
+	return node.pageBytes() - (node.headerSize() - HEADER) + int(node.nkeys())*plen
+}
+
+// get the value of a key and whether the key was there.
+// the returned slice might point into the page and must not be modified.
+// it panics on a corrupt page, see Check.
+func (tree *BTree) Get(key []byte) ([]byte, bool) {
+	if tree.root == 0 || len(key) == 0 {
+		return nil, false // the empty key is the sentinel, not a real key
+	}
+	return treeGet(tree, tree.get(tree.root), key)
+}
+
+// InsertMode selects what InsertEx does with new and existing keys
+type InsertMode int
+
+const (
+	MODE_UPSERT      InsertMode = 0 // insert or update
+	MODE_UPDATE_ONLY InsertMode = 1 // update existing keys
+	MODE_INSERT_ONLY InsertMode = 2 // only add new keys
+)
+
+// an insertion request for InsertEx
+type InsertReq struct {
+	// in
+	Key  []byte
+	Val  []byte
+	Mode InsertMode
+	// out
+	Added   bool   // a new key was added
+	Updated bool   // a new key was added or the value of a key was changed
+	Old     []byte // the previous value, nil if the key was not there
+	// the value must match it for an update, used by CompareAndSwap
+	expected []byte
+	cas      bool
+}
+
 // insert a new key or update an existing key
-func (tree *BTree) Insert(key []byte, val []byte) {
-	utils.Assert(len(key) != 0)
-	utils.Assert(len(key) <= BTREE_MAX_KEY_SIZE)
-	utils.Assert(len(val) <= BTREE_MAX_VAL_SIZE)
+func (tree *BTree) Insert(key []byte, val []byte) error {
+	return tree.InsertEx(&InsertReq{Key: key, Val: val})
+}
+
+// insert or update a key depending on the mode, the result is in the request
+func (tree *BTree) InsertEx(req *InsertReq) error {
+	req.Added, req.Updated, req.Old = false, false, nil
+	if err := checkKV(req.Key, req.Val); err != nil {
+		return err
+	}
+	switch req.Mode {
+	case MODE_UPSERT, MODE_UPDATE_ONLY, MODE_INSERT_ONLY:
+	default:
+		return fmt.Errorf("%w: insert mode %d", ErrInvalidOptions, req.Mode)
+	}
+	if err := tree.checkWritable(); err != nil {
+		return err
+	}
 	if tree.root == 0 {
+		if req.Mode == MODE_UPDATE_ONLY {
+			return nil
+		}
 		//create the first node
-		root := BNode(make([]byte, BTREE_PAGE_SIZE))
+		root := BNode(make([]byte, tree.pageSize()))
 		root.setHeader(BNODE_LEAF, 2)
 		// a dummy key, this makes the tree cover the whole key space.
 		// thus a lookup can always find a containing node.
 		nodeAppendKV(root, 0, 0, nil, nil)
-		nodeAppendKV(root, 1, 0, key, val)
-		tree.root = tree.new(root)
-		return
+		stored, kflag := tree.storeKey(req.Key)
+		storedVal, vflag := tree.storeValue(req.Val)
+		nodeAppendKVFlags(root, 1, 0, stored, storedVal, kflag, vflag)
+		tree.publish(tree.newNode(root))
+		req.Added, req.Updated = true, true
+		return nil
 	}
 
-	node := treeInsert(tree, tree.get(tree.root), key, val)
-	nsplit, split := nodeSplit3(node)
+	node, err := treeInsert(tree, req, tree.get(tree.root))
+	if err != nil || len(node) == 0 {
+		return err
+	}
 	tree.del(tree.root)
+	tree.setRoot(node)
+	return nil
+}
+
+// update a key only if its current value is the expected value, in a single
+// pass. returns whether the value matched, a missing key never matches.
+func (tree *BTree) CompareAndSwap(key []byte, expected []byte, val []byte) (bool, error) {
+	req := &InsertReq{Key: key, Val: val, Mode: MODE_UPDATE_ONLY, expected: expected, cas: true}
+	if err := tree.InsertEx(req); err != nil {
+		return false, err
+	}
+	return req.Old != nil && bytes.Equal(req.Old, expected), nil
+}
+
+// allocate the updated root, the tree grows a level if the root is split
+func (tree *BTree) setRoot(updated BNode) {
+	nsplit, split := nodeSplit3(tree, updated)
 	if nsplit > 1 {
-		root := BNode(make([]byte, BTREE_PAGE_SIZE))
-		root.setHeader(BNODE_NODE, nsplit)
-		for i, knode := range split[:nsplit] {
-			ptr, key := tree.new(knode), knode.getKey(0)
-			nodeAppendKV(root, uint16(i), ptr, key, nil)
-		}
-		tree.root = tree.new(root)
+		root := BNode(make([]byte, tree.pageSize()))
+		nodeBuild(root, BNODE_NODE, tree.linkKids(split[:nsplit], tree.newNode))
+		tree.publish(tree.newNode(root))
 	} else {
-		tree.root = tree.new(split[0])
+		tree.publish(tree.newNode(split[0]))
 	}
 }
 
 // delete a key and returns whether the key was there
-func (tree *BTree) Delete(key []byte) bool {
-	utils.Assert(len(key) != 0)
-	utils.Assert(len(key) <= BTREE_PAGE_SIZE)
+func (tree *BTree) Delete(key []byte) (bool, error) {
+	if err := checkKV(key, nil); err != nil {
+		return false, err
+	}
+	if err := tree.checkWritable(); err != nil {
+		return false, err
+	}
 	if tree.root == 0 {
-		return false
+		return false, nil
+	}
+	updated, err := treeDelete(tree, tree.get(tree.root), key)
+	if err != nil || len(updated) == 0 {
+		return false, err
+	}
+
+	tree.del(tree.root)
+	if updated.btype() == BNODE_NODE && updated.nkeys() == 1 {
+		tree.publish(updated.getPtr(0))
+	} else {
+		tree.setRoot(updated) // the separators might have grown
+	}
+	return true, nil
+}
+
+// delete all keys with the prefix in a single pass, returns the number of deleted keys
+func (tree *BTree) DeletePrefix(prefix []byte) (int, error) {
+	if err := tree.checkWritable(); err != nil {
+		return 0, err
+	}
+	if tree.root != 0 && !tree.cfg.bytewise {
+		return tree.deletePrefixScan(prefix)
+	}
+	return tree.DeleteRange(prefix, prefixEnd(prefix))
+}
+
+// delete the keys in [start, end) in a single pass, a nil end is unbounded.
+// only the boundary leaves are rewritten, the subtrees in between are
+// released as a whole. returns the number of deleted keys.
+func (tree *BTree) DeleteRange(start []byte, end []byte) (int, error) {
+	if err := tree.checkWritable(); err != nil {
+		return 0, err
+	}
+	if tree.root == 0 || (end != nil && tree.compare(start, end) >= 0) {
+		return 0, nil
 	}
-	updated := treeDelete(tree, tree.get(tree.root), key)
-	if len(updated) == 0 {
-		return false
+	freed := []uint64{}
+	updated, deleted, err := treeDeleteRange(tree, tree.get(tree.root), start, end, &freed)
+	if err != nil || deleted == 0 {
+		return 0, err
+	}
+	for _, ptr := range freed {
+		tree.del(ptr)
 	}
 
 	tree.del(tree.root)
 	if updated.btype() == BNODE_NODE && updated.nkeys() == 1 {
-		tree.root = updated.getPtr(0)
+		// drop the levels that are left with a single kid
+		ptr := updated.getPtr(0)
+		for node := tree.get(ptr); node.btype() == BNODE_NODE && node.nkeys() == 1; node = tree.get(ptr) {
+			tree.del(ptr)
+			ptr = node.getPtr(0)
+		}
+		tree.publish(ptr)
 	} else {
-		tree.root = tree.new(updated)
+		tree.setRoot(updated)
+	}
+	return deleted, nil
+}
+
+// DeletePrefix for a custom comparator, the keys with the prefix are not a
+// range, so they are found by a scan and deleted as a batch.
+func (tree *BTree) deletePrefixScan(prefix []byte) (int, error) {
+	b := &Batch{}
+	for sc := tree.ScanPrefix(prefix); sc.Valid(); sc.Next() {
+		b.Delete(sc.Key())
+	}
+	if b.Len() == 0 {
+		return 0, nil
+	}
+	if err := tree.Apply(b); err != nil {
+		return 0, err
 	}
-	return true
+	return b.Len(), nil
 }
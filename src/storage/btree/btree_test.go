@@ -2,8 +2,13 @@ package btree
 
 import (
 	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"math/rand"
+	"sort"
+	"strings"
 	"testing"
-	"unsafe"
 
 	"github.com/harish876/scratchdb/src/utils"
 )
@@ -11,35 +16,56 @@ import (
 type C struct {
 	tree  BTree
 	ref   map[string]string // the reference data
-	pages map[uint64]BNode  // in-memory pages
+	store *MemStore         // in-memory pages
 }
 
-func newC() *C {
-	pages := map[uint64]BNode{}
+func newC(opts ...Options) *C {
+	store := NewMemStore()
+	tree, err := New(store, opts...)
+	utils.Assert(err == nil)
 	return &C{
-		tree: BTree{
-			get: func(ptr uint64) BNode {
-				node, ok := pages[ptr]
-				utils.Assert(ok)
-				return node
-			},
-			new: func(node []byte) uint64 {
-				utils.Assert(BNode(node).nbytes() <= BTREE_PAGE_SIZE)
-				ptr := uint64(uintptr(unsafe.Pointer(&node[0])))
-				utils.Assert(pages[ptr] == nil)
-				pages[ptr] = node
-				return ptr
-			},
-			del: func(ptr uint64) {
-				utils.Assert(pages[ptr] != nil)
-				delete(pages, ptr)
-			},
-		},
+		tree:  *tree,
 		ref:   map[string]string{},
-		pages: pages,
+		store: store,
 	}
 }
 
+// insert a key into both the tree and the reference map
+func (c *C) add(key string, val string) {
+	err := c.tree.Insert([]byte(key), []byte(val))
+	utils.Assert(err == nil, "Insert should succeed: "+key)
+	c.ref[key] = val
+}
+
+// delete a key from both the tree and the reference map
+func (c *C) del(key string) bool {
+	delete(c.ref, key)
+	deleted, err := c.tree.Delete([]byte(key))
+	utils.Assert(err == nil, "Delete should succeed: "+key)
+	return deleted
+}
+
+// check every key of the reference map against the tree
+func (c *C) verify() {
+	for key, val := range c.ref {
+		got, ok := c.tree.Get([]byte(key))
+		utils.Assert(ok, "Key should be found: "+key)
+		utils.Assert(bytes.Equal(got, []byte(val)), "Value mismatch for key: "+key)
+	}
+	err := c.tree.Check()
+	utils.Assert(err == nil, fmt.Sprint("Tree check failed: ", err))
+}
+
+// the reference keys in sorted order
+func (c *C) sortedKeys() []string {
+	keys := make([]string, 0, len(c.ref))
+	for key := range c.ref {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
 func TestHeaders(t *testing.T) {
 	node := BNode(make(BNode, BTREE_PAGE_SIZE))
 	node.setHeader(BNODE_LEAF, 1)
@@ -66,18 +92,19 @@ func TestBTreeInsert(t *testing.T) {
 	container := newC()
 	utils.Assert(container.tree.root == uint64(0))
 
-	keyTooLong := make([]byte, 1001)
-	utils.AssertPanic(t, func() { container.tree.Insert(keyTooLong, nil) }, "Key too long")
-	valueTooLong := make([]byte, 3001)
-	utils.AssertPanic(t, func() { container.tree.Insert([]byte{byte(0)}, valueTooLong) }, "Value too long")
+	keyTooLong := make([]byte, BTREE_MAX_OVERFLOW_SIZE+1)
+	utils.Assert(container.tree.Insert(keyTooLong, nil) == ErrKeyTooLarge, "Key too long")
+	valueTooLong := make([]byte, BTREE_MAX_OVERFLOW_SIZE+1)
+	utils.Assert(container.tree.Insert([]byte{byte(0)}, valueTooLong) == ErrValueTooLarge, "Value too long")
 
-	utils.AssertPanic(t, func() { container.tree.Insert(nil, nil) }, "Null KV pair")
+	utils.Assert(container.tree.Insert(nil, nil) == ErrEmptyKey, "Null KV pair")
+	utils.Assert(container.tree.root == uint64(0), "Bad input should not create the root")
 
 	// Insert a valid key-value pair
 	key5 := make([]byte, 1000)
 	key5[0] = byte(5)
 	val5 := make([]byte, 200)
-	container.tree.Insert(key5, val5)
+	utils.Assert(container.tree.Insert(key5, val5) == nil)
 
 	utils.Assert(container.tree.root != 0, "Root should not be 0")
 	root := container.tree.get(container.tree.root)
@@ -90,13 +117,13 @@ func TestBTreeInsert(t *testing.T) {
 
 	// Update the value for the existing key
 	val5 = make([]byte, 3000)
-	container.tree.Insert(key5, val5)
+	utils.Assert(container.tree.Insert(key5, val5) == nil)
 
 	// Insert a long key-value pair
 	key7 := make([]byte, 1000)
 	key7[0] = byte(7)
 	val7 := make([]byte, 3000)
-	container.tree.Insert(key7, val7)
+	utils.Assert(container.tree.Insert(key7, val7) == nil)
 
 	root = container.tree.get(container.tree.root)
 	utils.Assert(root.btype() == uint16(BNODE_NODE), "Root should be an internal node")
@@ -122,7 +149,7 @@ func TestBTreeInsert(t *testing.T) {
 	key9 := make([]byte, 1000)
 	key9[0] = byte(9)
 	val9 := make([]byte, 3000)
-	container.tree.Insert(key9, val9)
+	utils.Assert(container.tree.Insert(key9, val9) == nil)
 	root = container.tree.get(container.tree.root)
 	utils.Assert(root.nkeys() == uint16(3), "Root should have 3 keys")
 
@@ -130,7 +157,7 @@ func TestBTreeInsert(t *testing.T) {
 	key11 := make([]byte, 1000)
 	key11[0] = byte(11)
 	val11 := make([]byte, 3000)
-	container.tree.Insert(key11, val11)
+	utils.Assert(container.tree.Insert(key11, val11) == nil)
 	root = container.tree.get(container.tree.root)
 	utils.Assert(root.nkeys() == uint16(4), "Root should have 4 keys")
 
@@ -138,27 +165,30 @@ func TestBTreeInsert(t *testing.T) {
 	key13 := make([]byte, 1000)
 	key13[0] = byte(13)
 	val13 := make([]byte, 3000)
-	container.tree.Insert(key13, val13)
+	utils.Assert(container.tree.Insert(key13, val13) == nil)
 	root = container.tree.get(container.tree.root)
-	utils.Assert(root.nkeys() == uint16(5), "Root should have 5 keys")
+	// the kid links carry the subtree counts, so 5 long separators no longer fit
+	utils.Assert(root.nkeys() == uint16(2), "Root should have 2 keys")
+	utils.Assert(bytes.Equal(root.getKey(1), key7), "Second key should be key7")
 
 	// Insert another long key-value pair
 	key15 := make([]byte, 1000)
 	key15[0] = byte(15)
 	val15 := make([]byte, 3000)
-	container.tree.Insert(key15, val15)
+	utils.Assert(container.tree.Insert(key15, val15) == nil)
 	root = container.tree.get(container.tree.root)
-	utils.Assert(root.nkeys() == uint16(2), "Root should have 2 keys")
+	utils.Assert(root.nkeys() == uint16(3), "Root should have 3 keys")
 	utils.Assert(bytes.Equal(root.getKey(0), []byte{}), "First key should be empty")
-	utils.Assert(bytes.Equal(root.getKey(1), key9), "Second key should be key9")
+	utils.Assert(bytes.Equal(root.getKey(1), key7), "Second key should be key7")
+	utils.Assert(bytes.Equal(root.getKey(2), key9), "Third key should be key9")
+	utils.Assert(root.kidCount(0) == 1 && root.kidCount(1) == 1 && root.kidCount(2) == 4, "Kid counts mismatch")
 
 	leftInternal := container.tree.get(root.getPtr(0))
 	utils.Assert(leftInternal.btype() == uint16(BNODE_NODE), "Left internal node should be an internal node")
-	utils.Assert(leftInternal.nkeys() == uint16(2), "Left internal node should have 2 keys")
+	utils.Assert(leftInternal.nkeys() == uint16(1), "Left internal node should have 1 key")
 	utils.Assert(bytes.Equal(leftInternal.getKey(0), []byte{}), "First key in left internal node should be empty")
-	utils.Assert(bytes.Equal(leftInternal.getKey(1), key7), "Second key in left internal node should be key7")
 
-	rightInternal := container.tree.get(root.getPtr(1))
+	rightInternal := container.tree.get(root.getPtr(2))
 	utils.Assert(rightInternal.btype() == uint16(BNODE_NODE), "Right internal node should be an internal node")
 	utils.Assert(rightInternal.nkeys() == uint16(4), "Right internal node should have 4 keys")
 	utils.Assert(bytes.Equal(rightInternal.getKey(0), key9), "First key in right internal node should be key9")
@@ -167,3 +197,1439 @@ func TestBTreeInsert(t *testing.T) {
 	utils.Assert(bytes.Equal(rightInternal.getKey(3), key15), "Fourth key in right internal node should be key15")
 
 }
+
+func TestBTreeGet(t *testing.T) {
+	container := newC()
+	_, ok := container.tree.Get([]byte("missing"))
+	utils.Assert(!ok, "Empty tree should not find any key")
+
+	// enough keys to split the root a few times
+	for i := 0; i < 2000; i++ {
+		key := fmt.Sprintf("key%06d", (i*7919)%2000)
+		container.add(key, fmt.Sprintf("val%d", i))
+	}
+	container.verify()
+	root := container.tree.get(container.tree.root)
+	utils.Assert(root.btype() == uint16(BNODE_NODE), "Root should be an internal node")
+
+	// update existing keys
+	for i := 0; i < 2000; i += 3 {
+		container.add(fmt.Sprintf("key%06d", i), fmt.Sprintf("new%d", i))
+	}
+	container.verify()
+
+	// delete some keys, they should no longer be found
+	for i := 0; i < 2000; i += 2 {
+		key := fmt.Sprintf("key%06d", i)
+		utils.Assert(container.del(key), "Key should be deleted: "+key)
+		_, ok := container.tree.Get([]byte(key))
+		utils.Assert(!ok, "Deleted key should not be found: "+key)
+	}
+	container.verify()
+
+	for _, key := range []string{"", "key", "key000000", "key0019999", "zzz"} {
+		_, ok := container.tree.Get([]byte(key))
+		utils.Assert(!ok, "Key should not be found: "+key)
+	}
+}
+
+func TestBTreeIter(t *testing.T) {
+	container := newC()
+	iter := container.tree.Seek([]byte("a"))
+	utils.Assert(!iter.Valid(), "Empty tree iterator should be invalid")
+
+	for i := 0; i < 1000; i++ {
+		key := fmt.Sprintf("key%06d", (i*7919)%1000*2)
+		container.add(key, fmt.Sprintf("val%d", i))
+	}
+	keys := container.sortedKeys()
+
+	// full forward scan skips the sentinel key
+	iter = container.tree.Seek([]byte{0})
+	for _, key := range keys {
+		utils.Assert(iter.Valid(), "Iterator should be valid at "+key)
+		utils.Assert(string(iter.Key()) == key, "Forward key mismatch at "+key)
+		utils.Assert(string(iter.Value()) == container.ref[key], "Forward value mismatch at "+key)
+		iter.Next()
+	}
+	utils.Assert(!iter.Valid(), "Iterator should be past the last key")
+
+	// full backward scan from the end
+	for i := len(keys) - 1; i >= 0; i-- {
+		iter.Prev()
+		utils.Assert(iter.Valid(), "Iterator should be valid at "+keys[i])
+		utils.Assert(string(iter.Key()) == keys[i], "Backward key mismatch at "+keys[i])
+	}
+	iter.Prev()
+	utils.Assert(!iter.Valid(), "Iterator should be before the first key")
+	iter.Next()
+	utils.Assert(string(iter.Key()) == keys[0], "Iterator should move back to the first key")
+
+	// seek to existing and missing keys
+	iter = container.tree.Seek([]byte("key000100"))
+	utils.Assert(string(iter.Key()) == "key000100", "Seek should find an existing key")
+	iter = container.tree.Seek([]byte("key000101"))
+	utils.Assert(string(iter.Key()) == "key000102", "Seek should find the next key")
+	iter.Prev()
+	utils.Assert(string(iter.Key()) == "key000100", "Prev after seek should find the previous key")
+	iter = container.tree.Seek([]byte("zzz"))
+	utils.Assert(!iter.Valid(), "Seek past the last key should be invalid")
+	iter.Prev()
+	utils.Assert(string(iter.Key()) == keys[len(keys)-1], "Prev past the end should find the last key")
+}
+
+// collect the keys yielded by a scanner
+func scanKeys(sc *Scanner) []string {
+	keys := []string{}
+	for ; sc.Valid(); sc.Next() {
+		keys = append(keys, string(sc.Key()))
+	}
+	return keys
+}
+
+// the expected keys of a scan computed from the reference map
+func (c *C) scanRef(start, end []byte, opts ScanOptions) []string {
+	keys := []string{}
+	for _, key := range c.sortedKeys() {
+		if start != nil && (key < string(start) || (key == string(start) && opts.StartExclusive)) {
+			continue
+		}
+		if end != nil && (key > string(end) || (key == string(end) && !opts.EndInclusive)) {
+			continue
+		}
+		keys = append(keys, key)
+	}
+	if opts.Reverse {
+		for i, j := 0, len(keys)-1; i < j; i, j = i+1, j-1 {
+			keys[i], keys[j] = keys[j], keys[i]
+		}
+	}
+	if opts.Limit > 0 && len(keys) > opts.Limit {
+		keys = keys[:opts.Limit]
+	}
+	return keys
+}
+
+func TestBTreeScan(t *testing.T) {
+	container := newC()
+	utils.Assert(len(scanKeys(container.tree.Scan(nil, nil, ScanOptions{}))) == 0, "Empty tree scan should yield nothing")
+
+	for i := 0; i < 1000; i++ {
+		key := fmt.Sprintf("key%06d", (i*7919)%1000*2)
+		container.add(key, fmt.Sprintf("val%d", i))
+	}
+
+	bounds := [][2][]byte{
+		{nil, nil},
+		{[]byte("key000100"), []byte("key000200")},
+		{[]byte("key000101"), []byte("key000199")},
+		{nil, []byte("key000050")},
+		{[]byte("key001900"), nil},
+		{[]byte("key000300"), []byte("key000300")},
+		{[]byte("a"), []byte("b")},
+		{[]byte("zzz"), nil},
+	}
+	for _, b := range bounds {
+		for _, startExclusive := range []bool{false, true} {
+			for _, endInclusive := range []bool{false, true} {
+				for _, reverse := range []bool{false, true} {
+					for _, limit := range []int{0, 1, 7} {
+						opts := ScanOptions{
+							StartExclusive: startExclusive,
+							EndInclusive:   endInclusive,
+							Reverse:        reverse,
+							Limit:          limit,
+						}
+						got := scanKeys(container.tree.Scan(b[0], b[1], opts))
+						want := container.scanRef(b[0], b[1], opts)
+						utils.Assert(fmt.Sprint(got) == fmt.Sprint(want),
+							fmt.Sprintf("Scan mismatch for %q-%q %+v", b[0], b[1], opts))
+					}
+				}
+			}
+		}
+	}
+
+	sc := container.tree.Scan([]byte("key000010"), nil, ScanOptions{})
+	utils.Assert(string(sc.Value()) == container.ref["key000010"], "Scan value mismatch")
+}
+
+// count the pages reachable from the root
+func (c *C) reachablePages() int {
+	var walk func(ptr uint64) int
+	walk = func(ptr uint64) int {
+		node := c.tree.get(ptr)
+		count := 1
+		for i := uint16(0); i < node.nkeys(); i++ {
+			if node.btype() == BNODE_NODE {
+				count += walk(node.getPtr(i))
+			} else {
+				count += len(c.tree.kvPages(node, i))
+			}
+		}
+		return count
+	}
+	if c.tree.root == 0 {
+		return 0
+	}
+	return walk(c.tree.root)
+}
+
+func TestBTreePrefix(t *testing.T) {
+	container := newC()
+	for i := 0; i < 3000; i++ {
+		for _, ns := range []string{"item/", "order/", "user/"} {
+			container.add(fmt.Sprintf("%s%06d", ns, (i*7919)%3000), fmt.Sprintf("%s%d", ns, i))
+		}
+	}
+	container.add("order", "no slash")
+	container.add("order0", "after the prefix")
+
+	got := scanKeys(container.tree.ScanPrefix([]byte("order/")))
+	utils.Assert(len(got) == 3000, "Prefix scan should find every key in the namespace")
+	utils.Assert(got[0] == "order/000000" && got[2999] == "order/002999", "Prefix scan should be ordered")
+	utils.Assert(len(scanKeys(container.tree.ScanPrefix([]byte("none/")))) == 0, "Missing prefix should yield nothing")
+
+	deleted, err := container.tree.DeletePrefix([]byte("order/"))
+	utils.Assert(err == nil, "DeletePrefix should succeed")
+	utils.Assert(deleted == 3000, fmt.Sprintf("DeletePrefix should delete 3000 keys, got %d", deleted))
+	for key := range container.ref {
+		if strings.HasPrefix(key, "order/") {
+			delete(container.ref, key)
+		}
+	}
+	container.verify()
+	utils.Assert(len(scanKeys(container.tree.ScanPrefix([]byte("order/")))) == 0, "Deleted namespace should be empty")
+	utils.Assert(fmt.Sprint(scanKeys(container.tree.Scan(nil, nil, ScanOptions{}))) == fmt.Sprint(container.sortedKeys()),
+		"Remaining keys should match the reference")
+	deleted, _ = container.tree.DeletePrefix([]byte("order/"))
+	utils.Assert(deleted == 0, "Second DeletePrefix should delete nothing")
+	utils.Assert(container.store.Live() == container.reachablePages(), "DeletePrefix should not leak pages")
+
+	// the empty prefix deletes everything but keeps the sentinel
+	deleted, _ = container.tree.DeletePrefix(nil)
+	utils.Assert(deleted == len(container.ref), "Empty prefix should delete every key")
+	container.ref = map[string]string{}
+	utils.Assert(len(scanKeys(container.tree.Scan(nil, nil, ScanOptions{}))) == 0, "Tree should be empty")
+	utils.Assert(container.store.Live() == 1, "Only the root leaf should be left")
+	container.add("user/1", "again")
+	container.verify()
+}
+
+func TestBTreeDeleteRange(t *testing.T) {
+	container := newC()
+	for i := 0; i < 20000; i++ {
+		container.ref[fmt.Sprintf("ts%08d", i)] = fmt.Sprintf("val%d", i)
+	}
+	container.ref["ts00010000"] = strings.Repeat("v", 20000)
+	utils.Assert(container.tree.BulkLoad(&refIter{container, container.sortedKeys()}, 0) == nil, "BulkLoad should succeed")
+
+	// only the boundary leaves and their parents are rewritten
+	allocated := int(container.store.Allocations())
+	deleted, err := container.tree.DeleteRange([]byte("ts00001000"), []byte("ts00019000"))
+	utils.Assert(err == nil && deleted == 18000, fmt.Sprintf("DeleteRange should delete 18000 keys, got %d", deleted))
+	newPages := int(container.store.Allocations()) - allocated
+	utils.Assert(newPages <= 4*container.height(), fmt.Sprintf("Covered subtrees should not be rewritten, %d new pages", newPages))
+	for i := 1000; i < 19000; i++ {
+		delete(container.ref, fmt.Sprintf("ts%08d", i))
+	}
+	container.verify()
+	container.verifyOrder()
+	utils.Assert(container.store.Live() == container.reachablePages(), "DeleteRange should not leak pages")
+
+	// empty and reversed ranges
+	deleted, _ = container.tree.DeleteRange([]byte("ts00001000"), []byte("ts00019000"))
+	utils.Assert(deleted == 0, "Deleting an empty range should delete nothing")
+	deleted, _ = container.tree.DeleteRange([]byte("ts00019500"), []byte("ts00000500"))
+	utils.Assert(deleted == 0, "A reversed range is empty")
+
+	// an unbounded end
+	deleted, _ = container.tree.DeleteRange([]byte("ts00019500"), nil)
+	utils.Assert(deleted == 500, "DeleteRange to the end should delete the tail")
+	for i := 19500; i < 20000; i++ {
+		delete(container.ref, fmt.Sprintf("ts%08d", i))
+	}
+	deleted, _ = container.tree.DeleteRange(nil, []byte("ts00000500"))
+	utils.Assert(deleted == 500, "DeleteRange from the start should delete the head")
+	for i := 0; i < 500; i++ {
+		delete(container.ref, fmt.Sprintf("ts%08d", i))
+	}
+	container.verify()
+	container.verifyOrder()
+	utils.Assert(container.store.Live() == container.reachablePages(), "DeleteRange should not leak pages")
+
+	// everything, the sentinel is kept
+	deleted, _ = container.tree.DeleteRange(nil, nil)
+	utils.Assert(deleted == len(container.ref), "DeleteRange(nil, nil) should delete every key")
+	container.ref = map[string]string{}
+	utils.Assert(container.tree.Count(nil, nil) == 0 && container.height() == 1, "The tree should be empty")
+	utils.Assert(container.store.Live() == container.reachablePages(), "DeleteRange should not leak pages")
+
+	// a large range leaves a few keys on both sides, the boundary nodes are
+	// merged and the levels above them dropped
+	container = newC()
+	for i := 0; i < 200000; i++ {
+		container.ref[fmt.Sprintf("ts%08d", i)] = fmt.Sprintf("val%d", i)
+	}
+	utils.Assert(container.tree.BulkLoad(&refIter{container, container.sortedKeys()}, 0) == nil, "BulkLoad should succeed")
+	utils.Assert(container.height() == 3, "The tree should have 3 levels")
+	deleted, _ = container.tree.DeleteRange([]byte("ts00000100"), []byte("ts00199900"))
+	utils.Assert(deleted == 199800, "DeleteRange should delete the middle")
+	for i := 100; i < 199900; i++ {
+		delete(container.ref, fmt.Sprintf("ts%08d", i))
+	}
+	container.verify()
+	utils.Assert(container.height() == 2, fmt.Sprintf("200 keys should fit under one root, height %d", container.height()))
+	utils.Assert(container.minNodeSize() >= container.tree.minFill(), fmt.Sprintf("Nodes should be at least MinFill full, %d bytes", container.minNodeSize()))
+	utils.Assert(container.store.Live() == container.reachablePages(), "DeleteRange should not leak pages")
+}
+
+// the smallest node below the root, in bytes
+func (c *C) minNodeSize() int {
+	smallest := c.tree.pageSize()
+	var walk func(ptr uint64)
+	walk = func(ptr uint64) {
+		node := c.tree.get(ptr)
+		if ptr != c.tree.root {
+			smallest = min(smallest, node.nbytes())
+		}
+		if node.btype() == BNODE_NODE {
+			for i := uint16(0); i < node.nkeys(); i++ {
+				walk(node.getPtr(i))
+			}
+		}
+	}
+	walk(c.tree.root)
+	return smallest
+}
+
+func TestBTreeRedistribute(t *testing.T) {
+	sizes := map[float64]int{}
+	for _, fill := range []float64{0, 0.5} {
+		container := newC(Options{MinFill: fill})
+		for i := 0; i < 20000; i++ {
+			container.ref[fmt.Sprintf("key%08d", i)] = fmt.Sprintf("val%d", i)
+		}
+		utils.Assert(container.tree.BulkLoad(&refIter{container, container.sortedKeys()}, 0) == nil, "BulkLoad should succeed")
+		// delete most keys, so that every leaf shrinks
+		for i := 0; i < 20000; i++ {
+			if i%5 != 0 {
+				container.del(fmt.Sprintf("key%08d", i))
+			}
+		}
+		container.verify()
+		container.verifyOrder()
+		utils.Assert(container.store.Live() == container.reachablePages(), "Deletes should not leak pages")
+		sizes[fill] = container.minNodeSize()
+		utils.Assert(sizes[fill] >= container.tree.minFill(), fmt.Sprintf("Nodes should stay above the min fill, got %d", sizes[fill]))
+	}
+	utils.Assert(sizes[0.5] > sizes[0], fmt.Sprint("A higher min fill keeps nodes denser ", sizes))
+
+	for _, fill := range []float64{-0.1, 0.6} {
+		_, err := newConfig(Options{MinFill: fill})
+		utils.Assert(errors.Is(err, ErrInvalidOptions), fmt.Sprintf("Min fill %v should be rejected", fill))
+	}
+}
+
+func TestBTreeErrors(t *testing.T) {
+	container := newC()
+	_, err := container.tree.Delete(nil)
+	utils.Assert(err == ErrEmptyKey, "Deleting the empty key should fail")
+	_, err = container.tree.Delete(make([]byte, BTREE_MAX_OVERFLOW_SIZE+1))
+	utils.Assert(err == ErrKeyTooLarge, "Deleting a too long key should fail")
+
+	for i := 0; i < 200; i++ {
+		container.add(fmt.Sprintf("key%06d", i), fmt.Sprintf("val%d", i))
+	}
+	root := container.tree.get(container.tree.root)
+	utils.Assert(root.btype() == BNODE_NODE, "Root should be an internal node")
+
+	// corrupt a leaf, updates that reach it should fail without changing the tree
+	leaf := container.tree.get(root.getPtr(1))
+	saved := append(BNode(nil), leaf...)
+	leaf.setHeader(7, leaf.nkeys())
+	key := leaf.getKey(0)
+	oldRoot := container.tree.root
+	err = container.tree.Insert(key, []byte("x"))
+	utils.Assert(errors.Is(err, ErrCorruptPage), "Insert into a corrupt page should fail")
+	_, err = container.tree.Delete(key)
+	utils.Assert(errors.Is(err, ErrCorruptPage), "Delete from a corrupt page should fail")
+	_, err = container.tree.DeletePrefix([]byte("key"))
+	utils.Assert(errors.Is(err, ErrCorruptPage), "DeletePrefix over a corrupt page should fail")
+	utils.Assert(container.tree.root == oldRoot, "Failed updates should keep the root")
+
+	leaf.setHeader(BNODE_LEAF, 60000)
+	err = container.tree.Insert(key, []byte("x"))
+	utils.Assert(errors.Is(err, ErrCorruptPage), "Too many keys should be reported as corrupt")
+
+	// a bad KV length
+	copy(leaf, saved)
+	binary.LittleEndian.PutUint16(leaf[leaf.kvPos(leaf.nkeys()-1):], 0x7000)
+	err = container.tree.Insert(key, []byte("x"))
+	utils.Assert(errors.Is(err, ErrCorruptPage), "Insert over a bad KV length should fail")
+	_, err = container.tree.Delete(key)
+	utils.Assert(errors.Is(err, ErrCorruptPage), "Delete over a bad KV length should fail")
+
+	copy(leaf, saved)
+	container.verify()
+}
+
+func TestBTreeOverflow(t *testing.T) {
+	container := newC()
+	large := func(seed int, size int) string {
+		val := make([]byte, size)
+		for i := range val {
+			val[i] = byte(seed + i*31)
+		}
+		return string(val)
+	}
+
+	// values around the inline limit and across page boundaries
+	per := container.tree.overflowDataSize()
+	sizes := []int{0, 1, BTREE_MAX_VAL_SIZE, BTREE_MAX_VAL_SIZE + 1, per, per + 1, 3 * per, 50000}
+	for i, size := range sizes {
+		container.add(fmt.Sprintf("key%02d", i), large(i, size))
+	}
+	container.verify()
+	utils.Assert(container.store.Live() == container.reachablePages(), "Overflow chains should be allocated from the tree")
+
+	// overflow pages hold whole chunks of the value
+	root := container.tree.get(container.tree.root)
+	idx := nodeLookupLE(&container.tree, root, []byte("key07"))
+	utils.Assert(root.isValueRef(idx), "Large value should be a reference")
+	utils.Assert(len(root.getValue(idx)) == OVERFLOW_REF_SIZE, "Reference should be inline")
+	pages := container.tree.kvPages(root, idx)
+	utils.Assert(len(pages) == (50000+per-1)/per, "Chain length mismatch")
+
+	// update large to small, small to large and large to large
+	container.add("key07", "small")
+	container.add("key01", large(100, 20000))
+	container.add("key06", large(200, 9000))
+	container.verify()
+	utils.Assert(container.store.Live() == container.reachablePages(), "Updates should free the old chains")
+
+	// enough large values to split the leaves
+	for i := 0; i < 100; i++ {
+		container.add(fmt.Sprintf("big%03d", i), large(i, 5000+i*100))
+	}
+	container.verify()
+	iter := container.tree.Seek([]byte("big050"))
+	utils.Assert(string(iter.Value()) == container.ref["big050"], "Iterator should read overflow values")
+
+	for i := 0; i < 100; i += 2 {
+		utils.Assert(container.del(fmt.Sprintf("big%03d", i)), "Large key should be deleted")
+	}
+	container.verify()
+	utils.Assert(container.store.Live() == container.reachablePages(), "Delete should free the chains")
+
+	deleted, err := container.tree.DeletePrefix([]byte("big"))
+	utils.Assert(err == nil && deleted == 50, "DeletePrefix should delete the large keys")
+	for key := range container.ref {
+		if strings.HasPrefix(key, "big") {
+			delete(container.ref, key)
+		}
+	}
+	container.verify()
+	utils.Assert(container.store.Live() == container.reachablePages(), "DeletePrefix should free the chains")
+}
+
+func TestBTreeOverflowKey(t *testing.T) {
+	container := newC()
+	// long keys that only differ after the inline prefix, or inside it
+	long := func(i int, size int) string {
+		key := strings.Repeat("k", size)
+		return key[:size-6] + fmt.Sprintf("%06d", i)
+	}
+	prefix := strings.Repeat("k", container.tree.keyPrefixSize())
+	keys := []string{
+		prefix, prefix + "a", prefix + "b", prefix[:len(prefix)-1] + "j" + "zzz",
+		long(1, BTREE_MAX_KEY_SIZE), long(2, BTREE_MAX_KEY_SIZE+1),
+		long(3, 5000), long(4, 20000), "short",
+	}
+	for i := 0; i < 300; i++ {
+		keys = append(keys, long((i*7919)%300, 1500+i))
+	}
+	for i, key := range keys {
+		container.add(key, fmt.Sprintf("val%d", i))
+	}
+	container.verify()
+	utils.Assert(container.store.Live() == container.reachablePages(), "Key tails should be allocated from the tree")
+
+	// the order of long keys is the order of the full keys
+	got := scanKeys(container.tree.Scan(nil, nil, ScanOptions{}))
+	utils.Assert(fmt.Sprint(got) == fmt.Sprint(container.sortedKeys()), "Long keys should be ordered by the full key")
+	_, ok := container.tree.Get([]byte(prefix + "c"))
+	utils.Assert(!ok, "Missing long key should not be found")
+
+	// updating a long key keeps its tail, large values still work
+	container.add(long(3, 5000), strings.Repeat("v", 10000))
+	container.add(long(4, 20000), "small")
+	container.verify()
+	utils.Assert(container.store.Live() == container.reachablePages(), "Updates should not leak key tails")
+
+	// deleting the first key of a leaf refreshes the separators sharing its tail
+	for i := 0; i < len(keys); i += 2 {
+		utils.Assert(container.del(keys[i]), "Long key should be deleted")
+	}
+	container.verify()
+	utils.Assert(container.store.Live() == container.reachablePages(), "Delete should free the key tails")
+
+	deleted, err := container.tree.DeletePrefix([]byte(prefix))
+	utils.Assert(err == nil && deleted > 0, "DeletePrefix should delete long keys")
+	for key := range container.ref {
+		if strings.HasPrefix(key, prefix) {
+			delete(container.ref, key)
+		}
+	}
+	container.verify()
+	utils.Assert(container.store.Live() == container.reachablePages(), "DeletePrefix should free the key tails")
+}
+
+func TestBTreePageSize(t *testing.T) {
+	for _, size := range []int{-1, 1000, 2048, 4095, 5000, 1 << 17} {
+		_, err := newConfig(Options{PageSize: size})
+		utils.Assert(errors.Is(err, ErrInvalidOptions), fmt.Sprintf("Page size %d should be rejected", size))
+	}
+	cfg, err := newConfig(Options{})
+	utils.Assert(err == nil && cfg.pageSize == BTREE_PAGE_SIZE, "Default page size")
+	utils.Assert(cfg.maxKeySize == BTREE_MAX_KEY_SIZE && cfg.maxValSize == BTREE_MAX_VAL_SIZE, "Default limits")
+
+	for _, size := range []int{4096, 8192, 16384, 32768, 65536} {
+		container := newC(Options{PageSize: size})
+		tree := &container.tree
+		utils.Assert(tree.maxKeySize() == BTREE_MAX_KEY_SIZE*size/BTREE_PAGE_SIZE, "Key limit should grow with the page")
+
+		// the largest inline KVs and overflow KVs just above the limits
+		container.add(strings.Repeat("a", tree.maxKeySize()), strings.Repeat("v", tree.maxValSize()))
+		container.add(strings.Repeat("b", tree.maxKeySize()+1), strings.Repeat("w", tree.maxValSize()+1))
+		for i := 0; i < 3000; i++ {
+			key := fmt.Sprintf("key%06d", (i*7919)%3000)
+			container.add(key, strings.Repeat("x", (i*37)%(tree.maxValSize()/8)))
+		}
+		for i := 0; i < 50; i++ {
+			container.add(fmt.Sprintf("max%03d", i), strings.Repeat("y", tree.maxValSize()-i))
+		}
+		container.verify()
+		root := tree.get(tree.root)
+		utils.Assert(root.btype() == BNODE_NODE, "Root should be an internal node")
+
+		for i := 0; i < 3000; i += 2 {
+			utils.Assert(container.del(fmt.Sprintf("key%06d", i)), "Key should be deleted")
+		}
+		container.verify()
+		utils.Assert(container.store.Live() == container.reachablePages(), "No pages should leak")
+	}
+}
+
+// a KVIter over sorted keys of the reference map
+type refIter struct {
+	c    *C
+	keys []string
+}
+
+func (iter *refIter) Next() ([]byte, []byte, bool) {
+	if len(iter.keys) == 0 {
+		return nil, nil, false
+	}
+	key := iter.keys[0]
+	iter.keys = iter.keys[1:]
+	return []byte(key), []byte(iter.c.ref[key]), true
+}
+
+// the height of the tree, all leaves must be at the same depth
+func (c *C) height() int {
+	height := 0
+	for ptr := c.tree.root; ptr != 0; height++ {
+		node := c.tree.get(ptr)
+		ptr = 0
+		if node.btype() == BNODE_NODE {
+			ptr = node.getPtr(0)
+		}
+	}
+	return height
+}
+
+func TestBTreeBulkLoad(t *testing.T) {
+	pages := map[float64]int{}
+	for _, fill := range []float64{0, 0.5, 0.75, 1} {
+		container := newC()
+		for i := 0; i < 20000; i++ {
+			container.ref[fmt.Sprintf("key%08d", i*3)] = fmt.Sprintf("val%d", i)
+		}
+		container.ref["large"] = strings.Repeat("v", 20000)
+		container.ref["long"+strings.Repeat("k", 3000)] = "long key"
+
+		err := container.tree.BulkLoad(&refIter{container, container.sortedKeys()}, fill)
+		utils.Assert(err == nil, "BulkLoad should succeed")
+		container.verify()
+		got := scanKeys(container.tree.Scan(nil, nil, ScanOptions{}))
+		utils.Assert(fmt.Sprint(got) == fmt.Sprint(container.sortedKeys()), "Bulk loaded keys should be ordered")
+		utils.Assert(container.store.Live() == container.reachablePages(), "BulkLoad should not leak pages")
+
+		// the tree is as dense as asked
+		utils.Assert(container.height() >= 2, "Tree should have internal nodes")
+		if fill > 0 {
+			pages[fill] = container.store.Live()
+		}
+
+		// the tree keeps working after the load
+		for i := 0; i < 2000; i++ {
+			container.add(fmt.Sprintf("key%08d", i*7+1), "new")
+			container.del(fmt.Sprintf("key%08d", i*9))
+		}
+		container.verify()
+		utils.Assert(container.store.Live() == container.reachablePages(), "Updates should not leak pages")
+	}
+	utils.Assert(pages[0.5] > pages[0.75]*5/4 && pages[0.75] > pages[1]*5/4, fmt.Sprint("Fill factor should set the density ", pages))
+
+	// a leaf per key, the last internal node of a level is not left with a single kid
+	for n := 1; n <= 200; n++ {
+		container := newC()
+		for i := 0; i < n; i++ {
+			container.ref[fmt.Sprintf("key%04d", i)] = strings.Repeat("v", 1500)
+		}
+		utils.Assert(container.tree.BulkLoad(&refIter{container, container.sortedKeys()}, BULK_MIN_FILL) == nil, "BulkLoad should succeed")
+		container.verify()
+		container.tree.walk(container.tree.root, 1, func(ptr uint64, node BNode, depth int) {
+			utils.Assert(node.btype() == BNODE_LEAF || node.nkeys() >= 2, fmt.Sprintf("An internal node should have 2 kids with %d keys", n))
+		})
+	}
+
+	// empty input leaves just the sentinel
+	container := newC()
+	utils.Assert(container.tree.BulkLoad(&refIter{container, nil}, 0) == nil, "Empty BulkLoad should succeed")
+	utils.Assert(len(scanKeys(container.tree.Scan(nil, nil, ScanOptions{}))) == 0, "Empty BulkLoad should have no keys")
+	container.add("a", "b")
+	container.verify()
+	utils.Assert(container.tree.BulkLoad(&refIter{container, nil}, 0) == ErrNotEmpty, "BulkLoad needs an empty tree")
+
+	// bad input frees everything
+	container = newC()
+	keys := []string{}
+	for i := 0; i < 5000; i++ {
+		keys = append(keys, fmt.Sprintf("key%08d", i))
+		container.ref[keys[i]] = strings.Repeat("v", i%5*2000)
+	}
+	keys = append(keys, "key00000001")
+	err := container.tree.BulkLoad(&refIter{container, keys}, 0)
+	utils.Assert(errors.Is(err, ErrUnsorted), "Unsorted input should fail")
+	utils.Assert(container.tree.root == 0 && container.store.Live() == 0, "Failed BulkLoad should free every page")
+	keys[5000] = ""
+	err = container.tree.BulkLoad(&refIter{container, keys}, 0)
+	utils.Assert(err == ErrEmptyKey, "Empty key should fail")
+	utils.Assert(container.tree.root == 0 && container.store.Live() == 0, "Failed BulkLoad should free every page")
+	for _, fill := range []float64{-1, 0.005, 0.1, BULK_MIN_FILL - 0.01, 1.01, 2} {
+		err = container.tree.BulkLoad(&refIter{container, nil}, fill)
+		utils.Assert(errors.Is(err, ErrInvalidOptions), fmt.Sprint("Bad fill factor ", fill))
+	}
+}
+
+// apply a batch to the tree, then to the reference map
+func (c *C) apply(b *Batch) {
+	utils.Assert(c.tree.Apply(b) == nil, "Apply should succeed")
+	for _, op := range b.ops {
+		if op.del {
+			delete(c.ref, string(op.key))
+		} else {
+			c.ref[string(op.key)] = string(op.val)
+		}
+	}
+}
+
+func TestBTreeBatch(t *testing.T) {
+	container := newC()
+	b := &Batch{}
+	for i := 0; i < 5000; i++ {
+		b.Put([]byte(fmt.Sprintf("key%06d", (i*7919)%5000)), []byte(fmt.Sprintf("val%d", i)))
+	}
+	b.Put([]byte("large"), []byte(strings.Repeat("v", 20000)))
+	b.Put([]byte("long"+strings.Repeat("k", 3000)), []byte("long key"))
+	b.Delete([]byte("missing"))
+	container.apply(b)
+	container.verify()
+	utils.Assert(container.height() >= 2, "Tree should have internal nodes")
+	utils.Assert(container.store.Live() == container.reachablePages(), "Apply should not leak pages")
+
+	// mixed updates, the last update of a key wins
+	for round := 0; round < 20; round++ {
+		b.Reset()
+		for i := 0; i < 500; i++ {
+			key := []byte(fmt.Sprintf("key%06d", (i*31+round*977)%6000))
+			switch i % 3 {
+			case 0:
+				b.Delete(key)
+			case 1:
+				b.Put(key, []byte(strings.Repeat("u", (i*round)%5000)))
+			case 2:
+				b.Put(key, []byte("first"))
+				b.Put(key, []byte(fmt.Sprintf("second%d", round)))
+			}
+		}
+		b.Delete([]byte("large"))
+		b.Put([]byte("long"+strings.Repeat("k", 3000)), []byte(strings.Repeat("w", round*1000)))
+		container.apply(b)
+		container.verify()
+		got := scanKeys(container.tree.Scan(nil, nil, ScanOptions{}))
+		utils.Assert(fmt.Sprint(got) == fmt.Sprint(container.sortedKeys()), "Keys should match the reference")
+		utils.Assert(container.store.Live() == container.reachablePages(), "Apply should not leak pages")
+	}
+
+	// a batch that deletes almost everything shrinks the tree
+	b.Reset()
+	for _, key := range container.sortedKeys()[1:] {
+		b.Delete([]byte(key))
+	}
+	container.apply(b)
+	container.verify()
+	utils.Assert(container.height() == 1, "A single key should fit into the root leaf")
+	utils.Assert(container.store.Live() == container.reachablePages(), "Apply should not leak pages")
+
+	// bad input and corrupt pages keep the tree as it was
+	for i := 0; i < 2000; i++ {
+		container.add(fmt.Sprintf("key%06d", i), fmt.Sprintf("val%d", i))
+	}
+	oldRoot, npages := container.tree.root, container.store.Live()
+	b.Reset()
+	b.Put([]byte("key000001"), []byte("x"))
+	b.Put(nil, nil)
+	utils.Assert(container.tree.Apply(b) == ErrEmptyKey, "Empty key should fail")
+	root := container.tree.get(container.tree.root)
+	last := container.tree.get(root.getPtr(root.nkeys() - 1))
+	btype := last.btype()
+	last.setHeader(7, last.nkeys())
+	b.Reset()
+	b.Put([]byte("key000001"), []byte(strings.Repeat("x", 10000)))
+	b.Put([]byte("zzz"), []byte("x"))
+	utils.Assert(errors.Is(container.tree.Apply(b), ErrCorruptPage), "Apply over a corrupt page should fail")
+	utils.Assert(container.tree.root == oldRoot, "Failed Apply should keep the root")
+	utils.Assert(container.store.Live() == npages, "Failed Apply should free its pages")
+	last.setHeader(btype, last.nkeys())
+	container.verify()
+
+	// a batch on an empty tree
+	container = newC()
+	b.Reset()
+	b.Delete([]byte("a"))
+	utils.Assert(container.tree.Apply(b) == nil && container.tree.root == 0, "Deleting from an empty tree changes nothing")
+	b.Put([]byte("a"), []byte("b"))
+	container.apply(b)
+	container.verify()
+}
+
+func TestBTreeBatchCompressed(t *testing.T) {
+	// leaves of exactly a page without a shared prefix, which the prefix
+	// length field of the compressed format would push past the page
+	container := newC(Options{PrefixCompression: true})
+	b := &Batch{}
+	for key, size := range map[string]int{"a": 2024, "b": 2024, "c": 2031, "d": 2031, "e": 2031, "f": 2031} {
+		b.Put([]byte(key), bytes.Repeat([]byte{'v'}, size))
+	}
+	container.apply(b)
+	container.verify()
+
+	// large values make leaves that are packed close to a full page
+	for seed := int64(0); seed < 50; seed++ {
+		rng := rand.New(rand.NewSource(seed))
+		container := newC(Options{PrefixCompression: true})
+		for round := 0; round < 4; round++ {
+			b.Reset()
+			for i := 0; i < 12; i++ {
+				key := make([]byte, 1+rng.Intn(20))
+				rng.Read(key)
+				if i%2 == 0 {
+					key = append([]byte("shared/"), key...)
+				}
+				b.Put(key, bytes.Repeat([]byte{'v'}, 200+rng.Intn(1801)))
+			}
+			container.apply(b)
+			container.verify()
+		}
+		utils.Assert(container.store.Live() == container.reachablePages(), "Apply should not leak pages")
+	}
+}
+
+func TestBTreeSnapshot(t *testing.T) {
+	container := newC()
+	tree := &container.tree
+	const nkeys = 500
+	batch := func(round int) *Batch {
+		b := &Batch{}
+		for i := 0; i < nkeys; i++ {
+			b.Put([]byte(fmt.Sprintf("key%06d", i)), []byte(fmt.Sprintf("round%d", round)))
+		}
+		if round%2 == 1 {
+			b.Delete([]byte("odd"))
+		} else {
+			b.Put([]byte("odd"), []byte(fmt.Sprintf("round%d", round)))
+		}
+		return b
+	}
+	utils.Assert(tree.Apply(batch(0)) == nil, "Apply should succeed")
+
+	// readers see every key of a snapshot from the same batch
+	done := make(chan struct{})
+	errs := make(chan error, 4)
+	for r := 0; r < 4; r++ {
+		go func() {
+			var err error
+			defer func() { errs <- err }()
+			for n := 0; ; n++ {
+				select {
+				case <-done:
+					if n > 0 {
+						return
+					}
+				default:
+				}
+				snap := tree.Snapshot()
+				first, _ := snap.Get([]byte("key000000"))
+				want := string(first)
+				for sc := snap.Scan(nil, nil, ScanOptions{}); sc.Valid(); sc.Next() {
+					if string(sc.Value()) != want {
+						err = fmt.Errorf("%s is %s, not %s", sc.Key(), sc.Value(), want)
+					}
+				}
+				round := 0
+				fmt.Sscanf(want, "round%d", &round)
+				if _, ok := snap.Get([]byte("odd")); ok != (round%2 == 0) {
+					err = fmt.Errorf("the odd key in %s", want)
+				}
+				snap.Release()
+				if err != nil {
+					return
+				}
+			}
+		}()
+	}
+	for round := 1; round <= 200; round++ {
+		utils.Assert(tree.Apply(batch(round)) == nil, "Apply should succeed")
+	}
+	close(done)
+	for r := 0; r < 4; r++ {
+		err := <-errs
+		utils.Assert(err == nil, fmt.Sprint("A snapshot should see a whole batch: ", err))
+	}
+
+	// the pages of released snapshots are freed by the next update
+	snap := tree.Snapshot()
+	utils.Assert(snap.Insert([]byte("a"), []byte("b")) == ErrReadOnly, "A snapshot is read-only")
+	utils.Assert(tree.Apply(batch(201)) == nil, "Apply should succeed")
+	utils.Assert(container.store.Live() > container.reachablePages(), "A snapshot should keep its pages")
+	val, _ := snap.Get([]byte("key000001"))
+	utils.Assert(string(val) == "round200", "A snapshot should not see later updates")
+	snap.Release()
+	utils.Assert(tree.Apply(batch(202)) == nil, "Apply should succeed")
+	utils.Assert(container.store.Live() == container.reachablePages(), "Released pages should be freed")
+}
+
+func TestBTreeSlottedLeaf(t *testing.T) {
+	sl := &slottedLeaf{}
+	sl.reset(256)
+	keys := func() string {
+		out := []string{}
+		for i := 0; i < sl.nslots; i++ {
+			key, _ := sl.getKey(i)
+			val, _ := sl.getValue(i)
+			out = append(out, string(key)+"="+string(val))
+		}
+		return strings.Join(out, ",")
+	}
+	utils.Assert(sl.insert(0, []byte("b"), []byte("2"), 0, 0), "Insert should fit")
+	utils.Assert(sl.insert(0, []byte("a"), []byte("1"), 0, 0), "Insert should fit")
+	utils.Assert(sl.insert(2, []byte("c"), []byte("3"), 0, 0), "Insert should fit")
+	utils.Assert(keys() == "a=1,b=2,c=3", "Slots should be shifted: "+keys())
+	sl.remove(1)
+	utils.Assert(sl.update(0, []byte("11"), 0), "Update should fit")
+	utils.Assert(keys() == "a=11,c=3", "Remove and update: "+keys())
+	utils.Assert(sl.garbage > 0, "Removed KVs are garbage until compaction")
+
+	// the garbage is reclaimed when the space runs out
+	for i := 0; i < 100; i++ {
+		utils.Assert(sl.update(1, []byte(fmt.Sprintf("%03d", i)), 0), "Update should reuse the space")
+	}
+	utils.Assert(keys() == "a=11,c=099", "Repeated updates: "+keys())
+	utils.Assert(!sl.insert(2, []byte("d"), make([]byte, 256), 0, 0), "A KV bigger than the space should not fit")
+
+	// the compacted BNode
+	node := sl.toNode(BTREE_PAGE_SIZE)
+	utils.Assert(len(node) == BTREE_PAGE_SIZE && node.btype() == BNODE_LEAF && node.nkeys() == 2, "Bad node")
+	utils.Assert(node.nbytes() == sl.nbytes(), "The node size should match")
+	utils.Assert(string(node.getKey(1)) == "c" && string(node.getValue(1)) == "099", "Bad KV")
+	sl.reset(256)
+	sl.load(node)
+	utils.Assert(keys() == "a=11,c=099", "Load should keep the KVs: "+keys())
+
+	// updates in place are split when the leaf grows too big
+	container := newC()
+	b := &Batch{}
+	for i := 0; i < 1000; i++ {
+		b.Put([]byte(fmt.Sprintf("key%06d", i)), []byte("v"))
+	}
+	container.apply(b)
+	for round := 0; round < 5; round++ {
+		b.Reset()
+		for i := 0; i < 1000; i += 10 {
+			b.Put([]byte(fmt.Sprintf("key%06d", i+round)), []byte(strings.Repeat("x", round*100)))
+			b.Delete([]byte(fmt.Sprintf("key%06d", i+round+5)))
+		}
+		container.apply(b)
+		container.verify()
+		utils.Assert(container.store.Live() == container.reachablePages(), "Apply should not leak pages")
+	}
+}
+
+// a batch of a few updates to a full leaf, in place on a slotted page and
+// by merging the KVs into new nodes
+func BenchmarkLeafApply(b *testing.B) {
+	container := newC()
+	batch := &Batch{}
+	for i := 0; i < 60; i++ {
+		batch.Put([]byte(fmt.Sprintf("key%04d", i*2)), bytes.Repeat([]byte{'v'}, 40))
+	}
+	container.apply(batch)
+	tree := &container.tree
+	leaf := tree.get(tree.root)
+	utils.Assert(leaf.btype() == BNODE_LEAF, "The root should be a leaf")
+
+	batch.Reset()
+	for i := 0; i < 8; i++ {
+		batch.Put([]byte(fmt.Sprintf("key%04d", i*14)), bytes.Repeat([]byte{'u'}, 40))
+		batch.Put([]byte(fmt.Sprintf("key%04d", i*14+1)), []byte("new"))
+		batch.Delete([]byte(fmt.Sprintf("key%04d", i*14+6)))
+	}
+	ops := tree.sortOps(batch.ops)
+
+	// a batch reuses its state across the leaves it updates
+	tx := &batchTx{tree: tree}
+	b.Run("InPlace", func(b *testing.B) {
+		b.ReportAllocs()
+		for i := 0; i < b.N; i++ {
+			tx.freed = tx.freed[:0]
+			_, _, ok := leafApplyInPlace(tx, leaf, ops)
+			utils.Assert(ok, "The leaf should be updated in place")
+		}
+	})
+	b.Run("Merge", func(b *testing.B) {
+		b.ReportAllocs()
+		for i := 0; i < b.N; i++ {
+			tx.freed = tx.freed[:0]
+			entries, _ := leafApply(tx, leaf, ops)
+			tree.packNodes(BNODE_LEAF, entries)
+		}
+	})
+}
+func TestBTreeCheck(t *testing.T) {
+	reversed := func(a, b []byte) int { return bytes.Compare(b, a) }
+	for _, opts := range []Options{{}, {PrefixCompression: true}, {Comparator: reversed}} {
+		container := newC(opts)
+		for i := 0; i < 2000; i++ {
+			container.add(fmt.Sprintf("key%06d/attributes", i), fmt.Sprintf("val%d", i))
+		}
+		container.add("large", strings.Repeat("v", 20000))
+		container.add("long"+strings.Repeat("k", 3000), "long key")
+		utils.Assert(container.tree.Check() == nil, "A good tree should pass the check")
+	}
+
+	// each corruption is reported, and the tree is restored after it
+	container := newC()
+	for i := 0; i < 2000; i++ {
+		container.add(fmt.Sprintf("key%06d", i), fmt.Sprintf("val%d", i))
+	}
+	container.add("large", strings.Repeat("v", 20000))
+	tree := &container.tree
+	root := tree.get(tree.root)
+	// a leaf with a few keys, not the first one
+	var leaf BNode
+	var find func(ptr uint64)
+	find = func(ptr uint64) {
+		node := tree.get(ptr)
+		for i := uint16(0); i < node.nkeys() && leaf == nil; i++ {
+			if node.btype() == BNODE_NODE {
+				find(node.getPtr(i))
+			} else if node.nkeys() >= 3 && len(node.getKey(0)) > 0 {
+				leaf = node
+			}
+		}
+	}
+	find(tree.root)
+	corrupt := func(page BNode, change func(), what string) {
+		saved := append(BNode(nil), page...)
+		change()
+		err := tree.Check()
+		utils.Assert(errors.Is(err, ErrCorruptPage), "Check should find "+what)
+		utils.Assert(strings.Contains(err.Error(), what), fmt.Sprint("Check should explain ", what, ": ", err))
+		copy(page, saved)
+		utils.Assert(tree.Check() == nil, "The restored tree should pass the check")
+	}
+	corrupt(leaf, func() { leaf.setHeader(7, leaf.nkeys()) }, "bad node type")
+	corrupt(leaf, func() { leaf.getKey(1)[3] = 'z' }, "keys are not sorted")
+	corrupt(leaf, func() { leaf.getKey(0)[3] = 'a' }, "the separator")
+	corrupt(leaf, func() { leaf.setHeader(BNODE_LEAF, leaf.nkeys()-1) }, "bad offset")
+	corrupt(root, func() { root.getValue(0)[0]++ }, "the count of kid")
+
+	// a leaf linked from a higher level
+	utils.Assert(container.height() > 2, "The tree should have 3 levels")
+	last := root.getPtr(root.nkeys() - 1)
+	for tree.get(last).btype() == BNODE_NODE {
+		last = tree.get(last).getPtr(tree.get(last).nkeys() - 1)
+	}
+	corrupt(root, func() { root.setPtr(root.nkeys()-1, last) }, "a leaf at depth")
+
+	// pages that can't be read are reported instead of a panic
+	corrupt(root, func() { root.setPtr(1, 1<<40) }, "can't be read from the path")
+	corrupt(root, func() { root.setPtr(1, 0) }, "null pointer of kid 1")
+
+	// an overflow chain shorter than its recorded length
+	var chain BNode
+	var findLarge func(ptr uint64)
+	findLarge = func(ptr uint64) {
+		node := tree.get(ptr)
+		for i := uint16(0); i < node.nkeys() && chain == nil; i++ {
+			if node.btype() == BNODE_NODE {
+				findLarge(node.getPtr(i))
+			} else if string(node.getKey(i)) == "large" {
+				chain = tree.get(binary.LittleEndian.Uint64(node.getValue(i)[4:]))
+			}
+		}
+	}
+	findLarge(tree.root)
+	utils.Assert(chain.overflowNext() != 0, "The large value should take a few pages")
+	corrupt(chain, func() { binary.LittleEndian.PutUint64(chain[HEADER:], 0) }, "the overflow chain ends after")
+
+	// a root leaf without the sentinel key
+	container = newC()
+	page := BNode(make([]byte, BTREE_PAGE_SIZE))
+	page.setHeader(BNODE_LEAF, 1)
+	nodeAppendKV(page, 0, 0, []byte("a"), []byte("b"))
+	container.tree.root = container.tree.new(page)
+	err := container.tree.Check()
+	utils.Assert(strings.Contains(fmt.Sprint(err), "the sentinel key is missing"), "Check should find the missing sentinel")
+}
+
+func TestBTreeStats(t *testing.T) {
+	container := newC()
+	stats, err := container.tree.Stats()
+	utils.Assert(err == nil && stats.Height == 0 && stats.Keys == 0, "An empty tree has no stats")
+	var text strings.Builder
+	utils.Assert(container.tree.DumpText(&text) == nil && text.String() == "empty\n", "Dump of an empty tree")
+
+	for i := 0; i < 2000; i++ {
+		container.add(fmt.Sprintf("key%06d", i), fmt.Sprintf("val%d", i))
+	}
+	container.add("large", strings.Repeat("v", 20000))
+	container.add("long"+strings.Repeat("k", 3000), "long key")
+	keyBytes, valBytes := 0, 0
+	for key, val := range container.ref {
+		keyBytes += len(key)
+		valBytes += len(val)
+	}
+
+	stats, err = container.tree.Stats()
+	utils.Assert(err == nil, "Stats should succeed")
+	utils.Assert(stats.Height == container.height(), "Height mismatch")
+	utils.Assert(stats.Keys == uint64(len(container.ref)), "Key count mismatch")
+	utils.Assert(stats.KeyBytes == uint64(keyBytes) && stats.ValueBytes == uint64(valBytes), fmt.Sprint("Byte count mismatch ", stats))
+	npages := stats.InternalPages + stats.LeafPages + stats.OverflowPages
+	utils.Assert(npages == container.reachablePages(), fmt.Sprint("Page count mismatch ", stats))
+	nfill := 0
+	for _, n := range stats.FillHistogram {
+		nfill += n
+	}
+	utils.Assert(nfill == stats.InternalPages+stats.LeafPages, "Every node should be in the histogram")
+
+	// the dumps show every node
+	text.Reset()
+	utils.Assert(container.tree.DumpText(&text) == nil, "DumpText should succeed")
+	utils.Assert(strings.Count(text.String(), "leaf ") == stats.LeafPages, "DumpText should show every leaf")
+	utils.Assert(strings.Contains(text.String(), `"key001999"`), "DumpText should show the keys")
+	utils.Assert(strings.Contains(text.String(), `"longkkkkkkkkkkkk"...`), "DumpText should cut long keys")
+	var dot strings.Builder
+	utils.Assert(container.tree.DumpDOT(&dot) == nil, "DumpDOT should succeed")
+	utils.Assert(strings.HasPrefix(dot.String(), "digraph btree {"), "DumpDOT should write a digraph")
+	nodes := stats.InternalPages + stats.LeafPages
+	utils.Assert(strings.Count(dot.String(), " -> ") == nodes-1, "DumpDOT should link every kid")
+	utils.Assert(strings.Count(dot.String(), "[label=") == nodes, "DumpDOT should show every node")
+
+	// a corrupt page is reported
+	root := container.tree.get(container.tree.root)
+	root.setHeader(7, root.nkeys())
+	_, err = container.tree.Stats()
+	utils.Assert(errors.Is(err, ErrCorruptPage), "Stats over a corrupt page should fail")
+	utils.Assert(errors.Is(container.tree.DumpDOT(&dot), ErrCorruptPage), "DumpDOT over a corrupt page should fail")
+	root.setHeader(BNODE_NODE, root.nkeys())
+}
+
+func TestBTreePageStore(t *testing.T) {
+	_, err := New(nil)
+	utils.Assert(errors.Is(err, ErrInvalidOptions), "A tree needs a page store")
+	_, err = New(NewMemStore(), Options{PageSize: 1000})
+	utils.Assert(errors.Is(err, ErrInvalidOptions), "Bad options should be rejected")
+
+	container := newC()
+	for i := 0; i < 500; i++ {
+		container.add(fmt.Sprintf("key%06d", i), fmt.Sprintf("val%d", i))
+	}
+	// a read-only store rejects every update and keeps the tree
+	container.store.SetReadOnly(true)
+	root, npages := container.tree.root, container.store.Live()
+	tree := &container.tree
+	utils.Assert(tree.Insert([]byte("new"), []byte("x")) == ErrReadOnly, "Insert should fail")
+	_, err = tree.CompareAndSwap([]byte("key000001"), []byte("val1"), []byte("x"))
+	utils.Assert(err == ErrReadOnly, "CompareAndSwap should fail")
+	_, err = tree.Delete([]byte("key000001"))
+	utils.Assert(err == ErrReadOnly, "Delete should fail")
+	_, err = tree.DeletePrefix([]byte("key"))
+	utils.Assert(err == ErrReadOnly, "DeletePrefix should fail")
+	_, err = tree.DeleteRange(nil, nil)
+	utils.Assert(err == ErrReadOnly, "DeleteRange should fail")
+	b := &Batch{}
+	b.Put([]byte("new"), []byte("x"))
+	utils.Assert(tree.Apply(b) == ErrReadOnly, "Apply should fail")
+	utils.Assert(tree.root == root && container.store.Live() == npages, "A read-only tree should not change")
+	container.verify()
+
+	empty := newC()
+	empty.store.SetReadOnly(true)
+	utils.Assert(empty.tree.BulkLoad(&refIter{container, container.sortedKeys()}, 0) == ErrReadOnly, "BulkLoad should fail")
+}
+
+// the error a function panics with
+func panicErr(f func()) (err error) {
+	defer func() {
+		if r := recover(); r != nil {
+			err, _ = r.(error)
+		}
+	}()
+	f()
+	return nil
+}
+
+func TestMemStore(t *testing.T) {
+	store := NewMemStore()
+	for i := 1; i <= 3; i++ {
+		utils.Assert(store.Allocate(make([]byte, BTREE_PAGE_SIZE)) == uint64(i), "Pages should be numbered from 1")
+	}
+	store.Free(2)
+	utils.Assert(store.Allocate(make([]byte, BTREE_PAGE_SIZE)) == 4, "Page numbers should not be reused")
+	utils.Assert(store.Live() == 3 && store.Allocations() == 4, "Live pages and allocations")
+	utils.Assert(errors.Is(panicErr(func() { store.Free(2) }), ErrDoubleFree), "A double free should be caught")
+	utils.Assert(errors.Is(panicErr(func() { store.Get(2) }), ErrCorruptPage), "A freed page should not be read")
+	utils.Assert(store.Live() == 3, "A bad free should not change the store")
+
+	// the pages of a tree, and the ones it lost
+	container := newC()
+	for i := 0; i < 1000; i++ {
+		container.add(fmt.Sprintf("key%06d", i), fmt.Sprintf("val%d", i))
+	}
+	container.add("large", strings.Repeat("v", 20000))
+	leaks, err := container.store.Leaks(&container.tree)
+	utils.Assert(err == nil && len(leaks) == 0, "The tree should own every page")
+	lost := container.store.Allocate(make([]byte, BTREE_PAGE_SIZE))
+	leaks, _ = container.store.Leaks(&container.tree)
+	utils.Assert(fmt.Sprint(leaks) == fmt.Sprint([]uint64{lost}), "A lost page should be reported")
+	container.store.Free(lost)
+	for key := range container.ref {
+		container.del(key)
+	}
+	leaks, _ = container.store.Leaks(&container.tree)
+	utils.Assert(len(leaks) == 0 && container.store.Live() == 1, "Only the root leaf should be left")
+}
+
+func TestBTreeInsertEx(t *testing.T) {
+	container := newC()
+	tree := &container.tree
+	insert := func(key string, val string, mode InsertMode) *InsertReq {
+		req := &InsertReq{Key: []byte(key), Val: []byte(val), Mode: mode}
+		utils.Assert(tree.InsertEx(req) == nil, "InsertEx should succeed")
+		return req
+	}
+
+	for _, mode := range []InsertMode{-1, 3, 100} {
+		err := tree.InsertEx(&InsertReq{Key: []byte("a"), Val: []byte("1"), Mode: mode})
+		utils.Assert(errors.Is(err, ErrInvalidOptions), fmt.Sprint("Mode ", mode, " should be rejected"))
+	}
+	utils.Assert(tree.root == 0, "A bad mode should not change the tree")
+
+	req := insert("a", "1", MODE_UPDATE_ONLY)
+	utils.Assert(!req.Added && !req.Updated && tree.root == 0, "Update-only should not create a key")
+	req = insert("a", "1", MODE_INSERT_ONLY)
+	utils.Assert(req.Added && req.Updated && req.Old == nil, "Insert-only should add a new key")
+	container.ref["a"] = "1"
+
+	for i := 0; i < 1000; i++ {
+		container.add(fmt.Sprintf("key%06d", i), fmt.Sprintf("val%d", i))
+	}
+	large := strings.Repeat("L", 10000)
+	container.add("large", large)
+	npages := container.store.Live()
+	oldRoot := tree.root
+
+	// no changes, no new pages
+	req = insert("key000500", "new", MODE_INSERT_ONLY)
+	utils.Assert(!req.Added && !req.Updated && string(req.Old) == "val500", "Insert-only should keep the key")
+	req = insert("missing", "new", MODE_UPDATE_ONLY)
+	utils.Assert(!req.Added && !req.Updated && req.Old == nil, "Update-only should skip a missing key")
+	req = insert("key000501", "val501", MODE_UPSERT)
+	utils.Assert(!req.Added && !req.Updated && string(req.Old) == "val501", "Same value should not update")
+	utils.Assert(tree.root == oldRoot && container.store.Live() == npages, "Unchanged tree should keep its pages")
+
+	// the old value is returned, including an overflow value
+	req = insert("key000500", "new", MODE_UPDATE_ONLY)
+	utils.Assert(!req.Added && req.Updated && string(req.Old) == "val500", "Update-only should update the key")
+	container.ref["key000500"] = "new"
+	req = insert("large", "small", MODE_UPSERT)
+	utils.Assert(!req.Added && req.Updated && string(req.Old) == large, "Upsert should return the old overflow value")
+	container.ref["large"] = "small"
+	req = insert("zzz", "end", MODE_UPSERT)
+	utils.Assert(req.Added && req.Updated && req.Old == nil, "Upsert should add a missing key")
+	container.ref["zzz"] = "end"
+	container.verify()
+	utils.Assert(container.store.Live() == container.reachablePages(), "InsertEx should not leak pages")
+}
+
+func TestBTreeCompareAndSwap(t *testing.T) {
+	container := newC()
+	tree := &container.tree
+	for i := 0; i < 1000; i++ {
+		container.add(fmt.Sprintf("key%06d", i), fmt.Sprintf("val%d", i))
+	}
+	container.add("empty", "")
+	npages := container.store.Live()
+	oldRoot := tree.root
+
+	ok, err := tree.CompareAndSwap([]byte("key000010"), []byte("stale"), []byte("new"))
+	utils.Assert(err == nil && !ok, "A stale value should not swap")
+	ok, _ = tree.CompareAndSwap([]byte("missing"), nil, []byte("new"))
+	utils.Assert(!ok, "A missing key should not swap")
+	utils.Assert(tree.root == oldRoot && container.store.Live() == npages, "Failed swaps should not touch the tree")
+
+	ok, err = tree.CompareAndSwap([]byte("key000010"), []byte("val10"), []byte("new"))
+	utils.Assert(err == nil && ok, "A matching value should swap")
+	container.ref["key000010"] = "new"
+	ok, _ = tree.CompareAndSwap([]byte("key000010"), []byte("val10"), []byte("newer"))
+	utils.Assert(!ok, "The second swap should see the new value")
+	ok, _ = tree.CompareAndSwap([]byte("empty"), nil, []byte("filled"))
+	utils.Assert(ok, "An empty value should match")
+	container.ref["empty"] = "filled"
+
+	large := strings.Repeat("L", 10000)
+	ok, _ = tree.CompareAndSwap([]byte("key000020"), []byte("val20"), []byte(large))
+	utils.Assert(ok, "Swapping in an overflow value should work")
+	ok, _ = tree.CompareAndSwap([]byte("key000020"), []byte(large), []byte("small"))
+	utils.Assert(ok, "Swapping out an overflow value should work")
+	container.ref["key000020"] = "small"
+	container.verify()
+	utils.Assert(container.store.Live() == container.reachablePages(), "CompareAndSwap should not leak pages")
+
+	_, err = tree.CompareAndSwap(nil, nil, nil)
+	utils.Assert(err == ErrEmptyKey, "The empty key should fail")
+}
+
+func TestBTreeComparator(t *testing.T) {
+	// big-endian integers in descending order
+	reversed := func(a, b []byte) int { return bytes.Compare(b, a) }
+	container := newC(Options{Comparator: reversed})
+	for i := 0; i < 3000; i++ {
+		key := fmt.Sprintf("%08x", (i*7919)%3000)
+		container.add(key, "v"+key)
+	}
+	long := strings.Repeat("f", 5000)
+	container.add(long, "long key")
+	container.verify()
+	got := scanKeys(container.tree.Scan(nil, nil, ScanOptions{}))
+	utils.Assert(got[0] == long && got[1] == "00000bb7" && got[len(got)-1] == "00000000", "Keys should be in descending order")
+	got = scanKeys(container.tree.Scan([]byte("00000010"), []byte("00000008"), ScanOptions{EndInclusive: true}))
+	utils.Assert(fmt.Sprint(got) == "[00000010 0000000f 0000000e 0000000d 0000000c 0000000b 0000000a 00000009 00000008]",
+		"Scan bounds should follow the comparator "+fmt.Sprint(got))
+	utils.Assert(container.del("00000010") && !container.del("00000010"), "Delete should follow the comparator")
+	container.verify()
+
+	// case-insensitive keys, keys with the same letters are the same key
+	ci := func(a, b []byte) int { return bytes.Compare(bytes.ToLower(a), bytes.ToLower(b)) }
+	container = newC(Options{Comparator: ci})
+	for i := 0; i < 2000; i++ {
+		container.add(fmt.Sprintf("key%05d", i), "lower")
+	}
+	container.tree.Insert([]byte("KEY00010"), []byte("upper"))
+	val, ok := container.tree.Get([]byte("Key00010"))
+	utils.Assert(ok && string(val) == "upper", "Mixed case keys should match")
+	utils.Assert(len(scanKeys(container.tree.Scan(nil, nil, ScanOptions{}))) == 2000, "No key should be added")
+
+	// prefix operations don't rely on adjacent keys
+	container = newC(Options{Comparator: reversed})
+	for i := 0; i < 2000; i++ {
+		container.add(fmt.Sprintf("%c%05d", 'a'+i%3, i), "v")
+	}
+	utils.Assert(len(scanKeys(container.tree.ScanPrefix([]byte("b")))) == 667, "ScanPrefix should filter the keys")
+	deleted, err := container.tree.DeletePrefix([]byte("b"))
+	utils.Assert(err == nil && deleted == 667, "DeletePrefix should delete the keys with the prefix")
+	for key := range container.ref {
+		if key[0] == 'b' {
+			delete(container.ref, key)
+		}
+	}
+	container.verify()
+	utils.Assert(len(scanKeys(container.tree.Scan(nil, nil, ScanOptions{}))) == len(container.ref), "Other keys should be kept")
+	utils.Assert(container.store.Live() == container.reachablePages(), "DeletePrefix should not leak pages")
+}
+
+// check the subtree counts of every kid link, returns the number of keys
+func (c *C) checkCounts(ptr uint64) uint64 {
+	node := c.tree.get(ptr)
+	if node.btype() == BNODE_LEAF {
+		return nodeCount(node)
+	}
+	count := uint64(0)
+	for i := uint16(0); i < node.nkeys(); i++ {
+		kcount := c.checkCounts(node.getPtr(i))
+		utils.Assert(node.kidCount(i) == kcount, "Kid count should match the subtree")
+		count += kcount
+	}
+	return count
+}
+
+// check Count, Rank and Nth against the reference map
+func (c *C) verifyOrder() {
+	keys := c.sortedKeys()
+	if c.tree.root != 0 {
+		utils.Assert(c.checkCounts(c.tree.root) == uint64(len(keys)), "Root count mismatch")
+	}
+	utils.Assert(c.tree.Count(nil, nil) == uint64(len(keys)), "Count mismatch")
+	for i := 0; i < len(keys); i += 1 + len(keys)/100 {
+		utils.Assert(c.tree.Rank([]byte(keys[i])) == uint64(i), "Rank mismatch: "+keys[i])
+		utils.Assert(c.tree.Rank([]byte(keys[i]+"\x00")) == uint64(i+1), "Rank of a missing key mismatch")
+		iter := c.tree.Nth(uint64(i))
+		utils.Assert(iter.Valid() && string(iter.Key()) == keys[i], "Nth mismatch")
+		j := min(len(keys)-1, i*7)
+		utils.Assert(c.tree.Count([]byte(keys[i]), []byte(keys[j])) == uint64(max(j-i, 0)), "Count range mismatch")
+	}
+	utils.Assert(!c.tree.Nth(uint64(len(keys))).Valid(), "Nth past the end should be invalid")
+}
+
+func TestBTreeOrderStats(t *testing.T) {
+	container := newC()
+	container.verifyOrder()
+	for i := 0; i < 5000; i++ {
+		container.add(fmt.Sprintf("key%06d", (i*7919)%5000), strings.Repeat("v", i%7*700))
+	}
+	container.verifyOrder()
+	iter := container.tree.Nth(10)
+	iter.Next()
+	utils.Assert(string(iter.Key()) == "key000011", "Nth should return a usable iterator")
+	utils.Assert(container.tree.Count([]byte("key001000"), []byte("key002000")) == 1000, "Count should be exact")
+	utils.Assert(container.tree.Rank([]byte("a")) == 0 && container.tree.Rank([]byte("z")) == 5000, "Rank outside the keys")
+
+	for i := 0; i < 5000; i += 3 {
+		container.del(fmt.Sprintf("key%06d", i))
+	}
+	container.verifyOrder()
+
+	b := &Batch{}
+	for i := 0; i < 3000; i++ {
+		if i%2 == 0 {
+			b.Delete([]byte(fmt.Sprintf("key%06d", i)))
+		} else {
+			b.Put([]byte(fmt.Sprintf("new%06d", i)), []byte("batch"))
+		}
+	}
+	container.apply(b)
+	container.verifyOrder()
+
+	deleted, _ := container.tree.DeletePrefix([]byte("new001"))
+	utils.Assert(deleted == 500, "DeletePrefix should delete 500 keys")
+	for key := range container.ref {
+		if strings.HasPrefix(key, "new001") {
+			delete(container.ref, key)
+		}
+	}
+	container.verifyOrder()
+
+	loaded := newC()
+	loaded.ref = container.ref
+	utils.Assert(loaded.tree.BulkLoad(&refIter{loaded, loaded.sortedKeys()}, 0) == nil, "BulkLoad should succeed")
+	loaded.verifyOrder()
+}
+
+func TestBTreePrefixCompression(t *testing.T) {
+	_, err := newConfig(Options{PrefixCompression: true, Comparator: bytes.Compare})
+	utils.Assert(errors.Is(err, ErrInvalidOptions), "Prefix compression needs the default order")
+
+	pages := []int{}
+	for _, compress := range []bool{false, true} {
+		container := newC(Options{PrefixCompression: compress})
+		for i := 0; i < 3000; i++ {
+			ns := []string{"tenant/0001/user/profile/", "tenant/0002/orders/by-date/"}[i%2]
+			container.add(fmt.Sprintf("%s%08d/attributes", ns, (i*7919)%3000), fmt.Sprintf("v%d", i))
+		}
+		long := "tenant/0003/" + strings.Repeat("k", 3000)
+		container.add(long+"1", strings.Repeat("v", 5000))
+		container.add(long+"2", "long key")
+		container.verify()
+		got := scanKeys(container.tree.Scan(nil, nil, ScanOptions{}))
+		utils.Assert(fmt.Sprint(got) == fmt.Sprint(container.sortedKeys()), "Keys should be in order")
+		utils.Assert(container.store.Live() == container.reachablePages(), "No pages should leak")
+
+		// lookups in the gaps of the truncated separators
+		for i := 0; i < 3000; i += 7 {
+			key := fmt.Sprintf("tenant/0001/user/profile/%08d/b", i)
+			_, ok := container.tree.Get([]byte(key))
+			utils.Assert(!ok, "Missing key should not be found")
+			iter := container.tree.Seek([]byte(key))
+			utils.Assert(iter.Valid() && string(iter.Key()) > key, "Seek should find the next key")
+			sc := container.tree.Scan(nil, []byte(key), ScanOptions{Reverse: true})
+			utils.Assert(sc.Valid() && string(sc.Key()) < key, "Reverse scan should start before the key")
+		}
+
+		// updates on the compressed form
+		for i := 0; i < 3000; i += 2 {
+			container.del(fmt.Sprintf("tenant/0001/user/profile/%08d/attributes", i))
+			container.add(fmt.Sprintf("tenant/0001/user/profile/%08d/b", i), "gap")
+		}
+		container.add("a", "no shared prefix")
+		container.add(long+"3", "another long key")
+		container.verify()
+		container.verifyOrder()
+		deleted, _ := container.tree.DeletePrefix([]byte("tenant/0002/"))
+		utils.Assert(deleted == 1500, "DeletePrefix should delete a namespace")
+		for key := range container.ref {
+			if strings.HasPrefix(key, "tenant/0002/") {
+				delete(container.ref, key)
+			}
+		}
+		b := &Batch{}
+		for i := 0; i < 1000; i++ {
+			b.Put([]byte(fmt.Sprintf("tenant/0004/batch/%08d", i)), []byte("batch"))
+			b.Delete([]byte(fmt.Sprintf("tenant/0001/user/profile/%08d/b", i)))
+		}
+		container.apply(b)
+		container.verify()
+		container.verifyOrder()
+		utils.Assert(container.store.Live() == container.reachablePages(), "No pages should leak")
+
+		loaded := newC(Options{PrefixCompression: compress})
+		loaded.ref = container.ref
+		utils.Assert(loaded.tree.BulkLoad(&refIter{loaded, loaded.sortedKeys()}, 0) == nil, "BulkLoad should succeed")
+		loaded.verify()
+		loaded.verifyOrder()
+		pages = append(pages, loaded.store.Live())
+
+		if compress {
+			// the nodes have a shared prefix and the separators after leaves are short
+			node := loaded.tree.get(loaded.tree.root)
+			utils.Assert(node.hasPrefix(), "Nodes should be in the prefix format")
+			for loaded.tree.get(node.getPtr(0)).btype() == BNODE_NODE {
+				node = loaded.tree.get(node.getPtr(node.nkeys() / 2))
+			}
+			leaf := loaded.tree.get(node.getPtr(1))
+			utils.Assert(len(leaf.prefix()) >= len("tenant/0001/"), fmt.Sprintf("Keys should share a prefix %q", leaf.prefix()))
+			truncated := 0
+			for i := uint16(1); i < node.nkeys(); i++ {
+				if _, ok := loaded.ref[string(node.getKey(i))]; !ok {
+					truncated++
+				}
+			}
+			utils.Assert(truncated > 0, "Separators should be truncated")
+		}
+	}
+	utils.Assert(pages[1] < pages[0]*2/3, fmt.Sprint("Compressed tree should take fewer pages ", pages))
+}
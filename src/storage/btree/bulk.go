@@ -0,0 +1,192 @@
+package btree
+
+import (
+	"fmt"
+)
+
+// the default fraction of a page that BulkLoad fills
+const BULK_DEFAULT_FILL = 0.9
+
+// the lowest fill factor, a smaller one makes nodes of a single KV and a
+// tree with almost as many levels as keys
+const BULK_MIN_FILL = 0.5
+
+// KVIter yields the key-value pairs for BulkLoad
+type KVIter interface {
+	// the next pair, ok is false at the end of the input.
+	// the returned slices are copied and can be reused by the iterator.
+	Next() (key []byte, val []byte, ok bool)
+}
+
+// the node being packed on one level of the tree
+type bulkLevel struct {
+	kvs  []kvEntry
+	size int       // the node size with the pending KVs
+	full []kvEntry // the full node before, kept so that the last 2 nodes can be balanced
+	last BNode     // the node written out before
+}
+
+// the state of a bulk load
+type bulkLoader struct {
+	tree   *BTree
+	limit  int          // pack a node up to this size
+	levels []*bulkLevel // leaves first
+}
+
+// BulkLoad builds the tree bottom-up from input sorted by key.
+// nodes are packed from left to right up to the fill fraction of a page
+// (0 is BULK_DEFAULT_FILL, it must be in [BULK_MIN_FILL, 1]), and the root
+// is assigned once at the end.
+// the tree must be empty, it's left empty if an error is returned.
+func (tree *BTree) BulkLoad(iter KVIter, fill float64) error {
+	if err := tree.checkWritable(); err != nil {
+		return err
+	}
+	if tree.root != 0 {
+		return ErrNotEmpty
+	}
+	if fill == 0 {
+		fill = BULK_DEFAULT_FILL
+	}
+	if fill < BULK_MIN_FILL || fill > 1 {
+		return fmt.Errorf("%w: fill factor %v", ErrInvalidOptions, fill)
+	}
+	bl := &bulkLoader{tree: tree, limit: int(fill * float64(tree.pageSize()))}
+	bl.add(0, kvEntry{}) // the sentinel key
+
+	var prev []byte
+	for {
+		key, val, ok := iter.Next()
+		if !ok {
+			break
+		}
+		if err := checkKV(key, val); err != nil {
+			bl.abort()
+			return err
+		}
+		if prev != nil && tree.compare(prev, key) >= 0 {
+			bl.abort()
+			return fmt.Errorf("%w: %q after %q", ErrUnsorted, key, prev)
+		}
+		prev = append(prev[:0], key...)
+
+		stored, kflag := tree.storeKey(key)
+		storedVal, vflag := tree.storeValue(val)
+		bl.add(0, kvEntry{
+			key: append([]byte{}, stored...), val: append([]byte{}, storedVal...),
+			kflag: kflag, vflag: vflag,
+		})
+	}
+	tree.publish(bl.finish())
+	return nil
+}
+
+// whether the level only has the sentinel key, which is too small to
+// be a node on its own
+func (level *bulkLevel) onlySentinel() bool {
+	return len(level.kvs) == 1 && len(level.kvs[0].key) == 0
+}
+
+// add a KV to a level, the full node is set aside first.
+// an internal node always gets at least 2 kids.
+func (bl *bulkLoader) add(height int, kv kvEntry) {
+	if height == len(bl.levels) {
+		bl.levels = append(bl.levels, &bulkLevel{size: HEADER})
+	}
+	level := bl.levels[height]
+	minKVs := 1
+	if height > 0 {
+		minKVs = 2
+	}
+	if len(level.kvs) >= minKVs && !level.onlySentinel() && bl.sizeWith(level, kv) > bl.limit {
+		bl.flush(height)
+	}
+	level.kvs = append(level.kvs, kv)
+	level.size += kv.size()
+}
+
+// the page size of the pending node of a level once the KV is added
+func (bl *bulkLoader) sizeWith(level *bulkLevel, kv kvEntry) int {
+	size := level.size + kv.size()
+	if !bl.tree.cfg.compress || len(level.kvs) == 0 {
+		return size
+	}
+	// the keys are sorted, the shared prefix is the one of the first and the last key
+	n := len(level.kvs) + 1
+	plen := min(commonPrefix(level.kvs[0].key, kv.key), bl.tree.keyPrefixSize())
+	return size + 2 + plen - n*plen
+}
+
+// write out the node set aside before, and set aside the pending node
+func (bl *bulkLoader) flush(height int) {
+	level := bl.levels[height]
+	if len(level.full) > 0 {
+		bl.write(height, level.full)
+	}
+	level.full, level.kvs = level.kvs, level.full[:0]
+	level.size = HEADER
+}
+
+// write out a node of a level and link it from the level above
+func (bl *bulkLoader) write(height int, kvs []kvEntry) {
+	level := bl.levels[height]
+	size := HEADER
+	for _, kv := range kvs {
+		size += kv.size()
+	}
+	node := newTempNode(size) // it fits into a page once encoded
+	if height == 0 {
+		nodeBuild(node, BNODE_LEAF, kvs)
+	} else {
+		nodeBuild(node, BNODE_NODE, kvs)
+	}
+	bl.add(height+1, bl.tree.kidLink(level.last, bl.tree.newNode(node), node))
+	level.last = node
+}
+
+// write out the pending nodes of every level, returns the root
+func (bl *bulkLoader) finish() uint64 {
+	for height := 0; ; height++ {
+		level := bl.levels[height]
+		if height > 0 && height == len(bl.levels)-1 && len(level.full) == 0 && len(level.kvs) == 1 {
+			return level.kvs[0].ptr // a single node on the top level
+		}
+		if height > 0 && len(level.full) > 0 && len(level.kvs) == 1 {
+			// a single kid is left, merge it into the node before, or
+			// move a kid over if they do not fit in a page
+			merged := append(level.full, level.kvs...)
+			if bl.tree.entriesSize(merged) <= bl.tree.pageSize() {
+				level.full, level.kvs = nil, merged
+			} else {
+				n := len(level.full) - 1
+				level.kvs = append([]kvEntry{level.full[n]}, level.kvs...)
+				level.full = level.full[:n]
+			}
+		}
+		for _, kvs := range [][]kvEntry{level.full, level.kvs} {
+			if len(kvs) > 0 {
+				bl.write(height, kvs)
+			}
+		}
+		level.full, level.kvs = nil, nil
+	}
+}
+
+// free every page written so far
+func (bl *bulkLoader) abort() {
+	for height, level := range bl.levels {
+		for _, kv := range append(level.full, level.kvs...) {
+			if height > 0 {
+				bl.tree.freeSubtree(kv.ptr)
+				continue
+			}
+			if kv.kflag != 0 {
+				bl.tree.freePages(bl.tree.overflowPages(kv.key[bl.tree.keyPrefixSize():]))
+			}
+			if kv.vflag != 0 {
+				bl.tree.freePages(bl.tree.overflowPages(kv.val))
+			}
+		}
+	}
+	bl.tree.publish(bl.tree.root) // the pages are not in any root
+}
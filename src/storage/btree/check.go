@@ -0,0 +1,208 @@
+package btree
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"strings"
+)
+
+// the number of problems Check() reports before it gives up
+const CHECK_MAX_ERRORS = 100
+
+// the state of a Check() walk
+type checker struct {
+	tree  *BTree
+	errs  []error
+	depth int      // the depth of the leaves, 0 if no leaf is seen yet
+	path  []uint64 // the pages from the root to the current one
+}
+
+// walk the whole tree and verify its invariants:
+// node types and sizes, the order of keys within and across nodes,
+// the separators, the subtree counts, the sentinel key, the overflow chains,
+// and that every leaf is at the same depth.
+// returns nil, or every problem found joined into one error.
+func (tree *BTree) Check() error {
+	if tree.root == 0 {
+		return nil
+	}
+	c := &checker{tree: tree}
+	c.node(tree.root, 1, nil, nil, true)
+	return errors.Join(c.errs...)
+}
+
+// record a problem found in a page
+func (c *checker) fail(ptr uint64, format string, args ...any) {
+	c.add(fmt.Errorf("%w: page %d: %s", ErrCorruptPage, ptr, fmt.Sprintf(format, args...)))
+}
+
+func (c *checker) add(err error) {
+	if len(c.errs) < CHECK_MAX_ERRORS {
+		c.errs = append(c.errs, err)
+	}
+}
+
+// read a page, a page the store fails to read is reported with the path to it
+func (c *checker) read(ptr uint64) (page BNode, ok bool) {
+	defer func() {
+		if r := recover(); r != nil {
+			path := make([]string, len(c.path))
+			for i, p := range c.path {
+				path[i] = fmt.Sprint(p)
+			}
+			c.fail(ptr, "can't be read from the path %s: %v", strings.Join(path, " -> "), r)
+			page, ok = nil, false
+		}
+	}()
+	return c.tree.get(ptr), true
+}
+
+// check a subtree whose keys are in [lo, hi), a nil hi is unbounded.
+// leftmost is whether it's on the path to the first leaf, with the sentinel.
+// returns the number of keys and the first key, or false if the node is bad.
+func (c *checker) node(ptr uint64, depth int, lo []byte, hi []byte, leftmost bool) (uint64, []byte, bool) {
+	tree := c.tree
+	node, ok := c.read(ptr)
+	if !ok {
+		return 0, nil, false
+	}
+	if err := checkNode(node); err != nil {
+		c.add(fmt.Errorf("page %d: %w", ptr, err))
+		return 0, nil, false
+	}
+	c.path = append(c.path, ptr)
+	defer func() { c.path = c.path[:len(c.path)-1] }()
+	if len(node) != tree.pageSize() {
+		c.fail(ptr, "page of %d bytes", len(node))
+	}
+	if node.pageBytes() > tree.pageSize() {
+		c.fail(ptr, "%d bytes do not fit in a page", node.pageBytes())
+	}
+	if node.hasPrefix() != tree.cfg.compress {
+		c.fail(ptr, "the key prefix format does not match the options")
+	}
+	nkeys := node.nkeys()
+	if nkeys == 0 {
+		c.fail(ptr, "no keys")
+		return 0, nil, false
+	}
+
+	// the keys, with the overflow tails
+	keys := make([][]byte, nkeys)
+	for i := uint16(0); i < nkeys; i++ {
+		if node.isKeyRef(i) {
+			stored := node.getKey(i)
+			if len(stored) != tree.keyPrefixSize()+OVERFLOW_REF_SIZE {
+				c.fail(ptr, "bad overflow key reference at %d", i)
+				return 0, nil, false
+			}
+			if !c.overflow(ptr, stored[tree.keyPrefixSize():]) {
+				return 0, nil, false
+			}
+		}
+		keys[i] = tree.readKey(node, i)
+	}
+	for i := uint16(0); i < nkeys; i++ {
+		key := keys[i]
+		empty := len(key) == 0
+		switch {
+		case empty && !(leftmost && i == 0):
+			c.fail(ptr, "empty key at %d", i)
+		case !empty && leftmost && i == 0:
+			c.fail(ptr, "the sentinel key is missing")
+		case i > 0 && tree.compare(keys[i-1], key) >= 0:
+			c.fail(ptr, "keys are not sorted at %d", i)
+		case i == 0 && !leftmost && lo != nil && tree.compare(key, lo) < 0:
+			c.fail(ptr, "the first key is below the separator")
+		case hi != nil && tree.compare(key, hi) >= 0:
+			c.fail(ptr, "key at %d is not below the next separator", i)
+		}
+	}
+
+	if node.btype() == BNODE_LEAF {
+		if c.depth == 0 {
+			c.depth = depth
+		} else if c.depth != depth {
+			c.fail(ptr, "a leaf at depth %d, others are at %d", depth, c.depth)
+		}
+		for i := uint16(0); i < nkeys; i++ {
+			if node.isValueRef(i) && !c.value(ptr, node.getValue(i)) {
+				return 0, nil, false
+			}
+		}
+		return nodeCount(node), keys[0], true
+	}
+
+	count, bad := uint64(0), false
+	for i := uint16(0); i < nkeys; i++ {
+		if len(node.getValue(i)) != 8 {
+			c.fail(ptr, "bad subtree count at %d", i)
+			bad = true
+			continue
+		}
+		var next []byte
+		if i+1 < nkeys {
+			next = keys[i+1]
+		} else {
+			next = hi
+		}
+		if node.getPtr(i) == 0 {
+			c.fail(ptr, "null pointer of kid %d", i)
+			bad = true
+			continue
+		}
+		kcount, first, ok := c.node(node.getPtr(i), depth+1, keys[i], next, leftmost && i == 0)
+		if !ok {
+			bad = true // the count and the first key are not known
+			continue
+		}
+		if kcount != node.kidCount(i) {
+			c.fail(ptr, "the count of kid %d is %d, the subtree has %d", i, node.kidCount(i), kcount)
+		}
+		count += kcount
+		// the separator is the first key of the kid, or a truncated prefix of it
+		sep := keys[i]
+		truncated := tree.cfg.compress && len(sep) < len(first) && bytes.HasPrefix(first, sep)
+		if !bytes.Equal(sep, first) && !truncated {
+			c.fail(ptr, "the separator at %d is not the first key of the kid", i)
+		}
+	}
+	return count, keys[0], !bad
+}
+
+// check an overflow value reference
+func (c *checker) value(ptr uint64, ref []byte) bool {
+	if len(ref) != OVERFLOW_REF_SIZE {
+		c.fail(ptr, "bad overflow value reference")
+		return false
+	}
+	return c.overflow(ptr, ref)
+}
+
+// check the pages of an overflow chain referenced from a leaf
+func (c *checker) overflow(leaf uint64, ref []byte) bool {
+	size := int(binary.LittleEndian.Uint32(ref[0:4]))
+	ptr := binary.LittleEndian.Uint64(ref[4:12])
+	if size > BTREE_MAX_OVERFLOW_SIZE {
+		c.fail(ptr, "overflow chain of %d bytes", size)
+		return false
+	}
+	for read := 0; read < size; read += c.tree.overflowDataSize() {
+		if ptr == 0 {
+			c.fail(leaf, "the overflow chain ends after %d of %d bytes", read, size)
+			return false
+		}
+		page, ok := c.read(ptr)
+		if !ok {
+			return false
+		}
+		if len(page) < OVERFLOW_HEADER || page.btype() != BNODE_OVERFLOW {
+			c.fail(ptr, "bad overflow page")
+			return false
+		}
+		ptr = page.overflowNext()
+	}
+	return true
+}
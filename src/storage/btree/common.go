@@ -1,22 +1,21 @@
 package btree
 
 import (
-	"bytes"
 	"encoding/binary"
 
 	"github.com/harish876/scratchdb/src/utils"
 )
 
 // returns the first kid node whose range intersects the key. (kid[i] <= key)
-func nodeLookupLE(node BNode, key []byte, useBSearch ...bool) uint16 {
+func nodeLookupLE(tree *BTree, node BNode, key []byte, useBSearch ...bool) uint16 {
 	nkeys := node.nkeys()
 	found := uint16(0)
 
 	if len(useBSearch) > 0 && useBSearch[0] {
-		left, right := uint16(1), nkeys+1
+		left, right := uint16(1), nkeys
 		for left < right {
 			mid := (left + right) / 2
-			cmp := bytes.Compare(node.getKey(mid), key)
+			cmp := tree.compareKey(node, mid, key)
 			if cmp <= 0 {
 				found = mid
 				left = mid + 1
@@ -27,7 +26,7 @@ func nodeLookupLE(node BNode, key []byte, useBSearch ...bool) uint16 {
 		return found
 	} else {
 		for i := uint16(1); i < nkeys; i++ {
-			cmp := bytes.Compare(node.getKey(i), key)
+			cmp := tree.compareKey(node, i, key)
 			if cmp <= 0 {
 				found = i
 			}
@@ -42,16 +41,25 @@ func nodeLookupLE(node BNode, key []byte, useBSearch ...bool) uint16 {
 
 // copy a KV into the position
 func nodeAppendKV(new BNode, idx uint16, ptr uint64, key []byte, val []byte) {
+	nodeAppendKVFlags(new, idx, ptr, key, val, 0, 0)
+}
+
+// copy a KV into the position, kflag and vflag are BTREE_LEN_OVERFLOW
+// if the key or the value is a reference to overflow pages
+func nodeAppendKVFlags(
+	new BNode, idx uint16, ptr uint64,
+	key []byte, val []byte, kflag uint16, vflag uint16,
+) {
 	// ptrs
 	new.setPtr(idx, ptr)
 	// KVs
 	pos := new.kvPos(idx)
-	binary.LittleEndian.PutUint16(new[pos:], uint16(len(key)))
-	binary.LittleEndian.PutUint16(new[pos+2:], uint16(len(val)))
+	binary.LittleEndian.PutUint16(new[pos:], uint16(len(key))|kflag)
+	binary.LittleEndian.PutUint16(new[pos+2:], uint16(len(val))|vflag)
 	copy(new[pos+4:], key)
-	copy(new[pos+4+uint16(len(key)):], val)
+	copy(new[pos+4+len(key):], val)
 	// the offset of the next key
-	new.setOffset(idx+1, new.getOffset(idx)+4+uint16((len(key)+len(val))))
+	new.setOffset(idx+1, new.getOffset(idx)+4+len(key)+len(val))
 }
 
 // copy multiple KVs into the position from the old node
@@ -59,14 +67,106 @@ func nodeAppendRange(new BNode, old BNode, dstNew uint16, srcOld uint16, n uint1
 	utils.Assert(srcOld+n <= old.nkeys())
 	utils.Assert(dstNew+n <= new.nkeys())
 
+	if len(old.prefix()) > 0 {
+		// the keys are written out in full
+		for i := uint16(0); i < n; i++ {
+			e := nodeEntry(old, srcOld+i)
+			nodeAppendKVFlags(new, dstNew+i, e.ptr, e.key, e.val, e.kflag, e.vflag)
+		}
+		return
+	}
+
 	for i := uint16(0); i < n; i++ {
 		// Copy pointer
 		ptr := old.getPtr(srcOld + i)
 		new.setPtr(dstNew+i, ptr)
 
-		// Copy key-value pair
-		key := old.getKey(srcOld + i)
-		val := old.getValue(srcOld + i)
-		nodeAppendKV(new, dstNew+i, ptr, key, val)
+		// Copy key-value pair as is, including the overflow flags
+		begin, end := old.kvPos(srcOld+i), old.kvPos(srcOld+i+1)
+		copy(new[new.kvPos(dstNew+i):], old[begin:end])
+		new.setOffset(dstNew+i+1, new.getOffset(dstNew+i)+(end-begin))
+	}
+}
+
+// link a kid from an internal node, the separator is the first key of the kid
+// and the value is the number of keys in the kid
+func nodeAppendKid(new BNode, idx uint16, ptr uint64, kid BNode) {
+	nodeAppendKVFlags(new, idx, ptr, kid.getKey(0), countValue(nodeCount(kid)), kid.keyFlag(0), 0)
+}
+
+// a KV to be written into a node, the key and the value are the stored
+// bytes and the flags mark overflow references.
+// for an internal node, it's the link to a kid.
+type kvEntry struct {
+	ptr          uint64
+	key          []byte
+	val          []byte
+	kflag, vflag uint16
+}
+
+// the space taken by the entry in a node
+func (e kvEntry) size() int {
+	return 8 + 2 + 4 + len(e.key) + len(e.val)
+}
+
+// the KV at the position as stored in the node
+func nodeEntry(node BNode, idx uint16) kvEntry {
+	return kvEntry{
+		ptr: node.getPtr(idx), key: node.getKey(idx), val: node.getValue(idx),
+		kflag: node.keyFlag(idx), vflag: node.valueFlag(idx),
+	}
+}
+
+// the link to a newly allocated kid, the separator is the first key of the kid
+func kidEntry(ptr uint64, kid BNode) kvEntry {
+	return kvEntry{ptr: ptr, key: kid.getKey(0), val: countValue(nodeCount(kid)), kflag: kid.keyFlag(0)}
+}
+
+// a temporary node that holds the size with 2-byte offsets, it's only written
+// to a page after it's split or compressed to fit. a node bigger than 64K
+// needs room for 4-byte offsets, a KV takes at least 14 bytes.
+func newTempNode(size int) BNode {
+	if size > 1<<16 {
+		size += size / 7
+	}
+	return BNode(make([]byte, size))
+}
+
+// build a node from the entries
+func nodeBuild(new BNode, btype uint16, entries []kvEntry) {
+	new.setHeader(btype, uint16(len(entries)))
+	for i, e := range entries {
+		nodeAppendKVFlags(new, uint16(i), e.ptr, e.key, e.val, e.kflag, e.vflag)
+	}
+}
+
+// pack the entries into as few pages as possible, and spread them evenly
+// so that the last node is not left almost empty
+func (tree *BTree) packNodes(btype uint16, entries []kvEntry) []BNode {
+	pageSize := tree.pageSize()
+	remaining := 0
+	for _, e := range entries {
+		remaining += e.size()
+	}
+	nodes := []BNode{}
+	for start := 0; start < len(entries); {
+		count := (remaining + pageSize - HEADER - 1) / (pageSize - HEADER)
+		target := HEADER + remaining/count
+		size, end := HEADER, start
+		for ; end < len(entries); end++ {
+			next := size + entries[end].size()
+			// the page size once encoded, with the shared prefix of the compressed format
+			encoded := next + tree.prefixOverhead(entries[start].key, entries[end].key, end-start+1)
+			if end > start && (encoded > pageSize || next-target > target-size) {
+				break // full, or closer to the target without the entry
+			}
+			size = next
+		}
+		node := newTempNode(max(size, pageSize)) // it fits into a page once encoded
+		nodeBuild(node, btype, entries[start:end])
+		nodes = append(nodes, node)
+		remaining -= size - HEADER
+		start = end
 	}
+	return nodes
 }
@@ -0,0 +1,125 @@
+package btree
+
+import (
+	"encoding/binary"
+
+	"github.com/harish876/scratchdb/src/utils"
+)
+
+// the length of the common prefix of 2 keys
+func commonPrefix(a []byte, b []byte) int {
+	n := 0
+	for n < len(a) && n < len(b) && a[n] == b[n] {
+		n++
+	}
+	return n
+}
+
+// the prefix shared by the stored keys in [lo, hi) of a sorted node.
+// it's the common prefix of the first and the last key, and it never goes
+// past the inline prefix of an overflow key.
+func (tree *BTree) rangePrefix(node BNode, lo uint16, hi uint16) []byte {
+	if !tree.cfg.compress || lo >= hi {
+		return nil
+	}
+	first := node.getKey(lo)
+	n := commonPrefix(first, node.getKey(hi-1))
+	return first[:min(n, tree.keyPrefixSize())]
+}
+
+// the page size of the KVs in [lo, hi) once the node is written out
+func (tree *BTree) encodedSize(node BNode, lo uint16, hi uint16) int {
+	n := int(hi - lo)
+	kvSize := node.kvPos(hi) - node.kvPos(lo) + n*len(node.prefix())
+	size := HEADER + n*8 + n*2 + kvSize
+	if tree.cfg.compress {
+		plen := len(tree.rangePrefix(node, lo, hi))
+		size += 2 + plen - n*plen
+	}
+	return size
+}
+
+// the page size of a node built from the sorted entries
+func (tree *BTree) entriesSize(entries []kvEntry) int {
+	size := HEADER
+	for _, e := range entries {
+		size += e.size()
+	}
+	if n := len(entries); n > 0 {
+		size += tree.prefixOverhead(entries[0].key, entries[n-1].key, n)
+	}
+	return size
+}
+
+// the bytes the compressed format adds to n sorted keys from first to last,
+// the prefix length field minus the shared prefix stored once. can be negative.
+func (tree *BTree) prefixOverhead(first []byte, last []byte, n int) int {
+	if !tree.cfg.compress {
+		return 0
+	}
+	plen := min(commonPrefix(first, last), tree.keyPrefixSize())
+	return 2 + plen - n*plen
+}
+
+// convert a temporary node to a page, the node must fit once it's encoded
+func (tree *BTree) encode(node BNode) BNode {
+	if !tree.cfg.compress {
+		utils.Assert(node.pageBytes() <= tree.pageSize(), "Assertion failed at encode")
+		return nodeFit(node, tree.pageSize())
+	}
+	nkeys := node.nkeys()
+	prefix := tree.rangePrefix(node, 0, nkeys)
+	page := BNode(make([]byte, tree.pageSize()))
+	binary.LittleEndian.PutUint16(page[0:2], node.btype()|BNODE_PREFIX)
+	binary.LittleEndian.PutUint16(page[2:4], nkeys)
+	binary.LittleEndian.PutUint16(page[HEADER:], uint16(len(prefix)))
+	copy(page[HEADER+2:], prefix)
+	for i := uint16(0); i < nkeys; i++ {
+		e := nodeEntry(node, i)
+		suffix := e.key[len(prefix):]
+		page.setPtr(i, e.ptr)
+		pos := page.kvPos(i)
+		binary.LittleEndian.PutUint16(page[pos:], uint16(len(suffix))|e.kflag)
+		binary.LittleEndian.PutUint16(page[pos+2:], uint16(len(e.val))|e.vflag)
+		copy(page[pos+4:], suffix)
+		copy(page[pos+4+len(suffix):], e.val)
+		page.setOffset(i+1, page.getOffset(i)+4+len(suffix)+len(e.val))
+	}
+	utils.Assert(page.nbytes() <= tree.pageSize(), "Assertion failed at encode")
+	return page
+}
+
+// write a temporary node to a new page
+func (tree *BTree) newNode(node BNode) uint64 {
+	return tree.new(tree.encode(node))
+}
+
+// the link to a kid that follows the left sibling. the separator after a leaf
+// is the shortest prefix of the kid's first key that is greater than every
+// key of the left leaf, so the parent holds fewer and shorter keys.
+func (tree *BTree) kidLink(left BNode, ptr uint64, kid BNode) kvEntry {
+	link := kidEntry(ptr, kid)
+	if !tree.cfg.compress || left == nil || kid.btype() != BNODE_LEAF {
+		return link
+	}
+	last := tree.readKey(left, left.nkeys()-1)
+	first := tree.readKey(kid, 0)
+	n := commonPrefix(last, first) + 1 // first > last
+	if n < len(first) && n <= tree.maxKeySize() {
+		link.key, link.kflag = first[:n], 0
+	}
+	return link
+}
+
+// write out the kids and link them in order
+func (tree *BTree) linkKids(kids []BNode, alloc func(BNode) uint64) []kvEntry {
+	links := make([]kvEntry, len(kids))
+	for i, kid := range kids {
+		var left BNode
+		if i > 0 {
+			left = kids[i-1]
+		}
+		links[i] = tree.kidLink(left, alloc(kid), kid)
+	}
+	return links
+}
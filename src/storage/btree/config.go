@@ -0,0 +1,113 @@
+package btree
+
+import (
+	"bytes"
+	"fmt"
+
+	"github.com/harish876/scratchdb/src/utils"
+)
+
+// Options configures a tree, the zero value selects the defaults.
+// the options are fixed when the tree is constructed.
+type Options struct {
+	// the size of a page: 4K, 8K, 16K, 32K or 64K, 0 is BTREE_PAGE_SIZE.
+	// BTREE_MAX_KEY_SIZE and BTREE_MAX_VAL_SIZE scale with it.
+	PageSize int
+	// the order of keys, nil is bytes.Compare.
+	// the empty key is always ordered first whatever the comparator says.
+	Comparator Comparator
+	// store the prefix shared by the keys of a node once, and truncate the
+	// separators that follow a leaf. it needs the default key order.
+	PrefixCompression bool
+	// the minimum fill of a node after a delete, as a fraction of the page.
+	// a node below it is merged with a sibling, or takes KVs from one.
+	// 0 is 1/4, at most 1/2.
+	MinFill float64
+}
+
+// Comparator orders keys like bytes.Compare, it returns -1, 0 or +1.
+// keys that compare equal are the same key.
+type Comparator func(a []byte, b []byte) int
+
+// the page size of a tree and the limits derived from it
+type config struct {
+	pageSize   int
+	maxKeySize int // larger keys keep a prefix inline and the tail in overflow pages
+	maxValSize int // larger values are moved to overflow pages
+	compare    Comparator
+	bytewise   bool // the keys are in bytes.Compare order
+	compress   bool // PrefixCompression
+	minFill    int  // MinFill in bytes
+}
+
+func newConfig(opts Options) (config, error) {
+	pageSize := opts.PageSize
+	if pageSize == 0 {
+		pageSize = BTREE_PAGE_SIZE
+	}
+	if pageSize < 4096 || pageSize > 1<<16 || pageSize&(pageSize-1) != 0 {
+		return config{}, fmt.Errorf("%w: page size %d", ErrInvalidOptions, pageSize)
+	}
+	// the 4K limits scaled with the page size.
+	// inline lengths must leave the BTREE_LEN_OVERFLOW bit free.
+	scale := pageSize / BTREE_PAGE_SIZE
+	cfg := config{
+		pageSize:   pageSize,
+		maxKeySize: BTREE_MAX_KEY_SIZE * scale,
+		maxValSize: min(BTREE_MAX_VAL_SIZE*scale, BTREE_LEN_OVERFLOW-1),
+		compare:    opts.Comparator,
+		bytewise:   opts.Comparator == nil,
+		compress:   opts.PrefixCompression,
+	}
+	if opts.MinFill < 0 || opts.MinFill > 0.5 {
+		return config{}, fmt.Errorf("%w: min fill %v", ErrInvalidOptions, opts.MinFill)
+	}
+	cfg.minFill = int(opts.MinFill * float64(pageSize))
+	if opts.MinFill == 0 {
+		cfg.minFill = pageSize / 4
+	}
+	if cfg.compress && !cfg.bytewise {
+		return config{}, fmt.Errorf("%w: prefix compression needs the default key order", ErrInvalidOptions)
+	}
+	if cfg.bytewise {
+		cfg.compare = bytes.Compare
+	}
+	// a node with a single KV of the maximum size must fit in a page
+	node1max := HEADER + 8 + 2 + 4 + cfg.maxKeySize + cfg.maxValSize
+	utils.Assert(node1max <= pageSize, "Assertion failed at newConfig")
+	return cfg, nil
+}
+
+func (tree *BTree) pageSize() int {
+	return tree.cfg.pageSize
+}
+
+func (tree *BTree) maxKeySize() int {
+	return tree.cfg.maxKeySize
+}
+
+func (tree *BTree) maxValSize() int {
+	return tree.cfg.maxValSize
+}
+
+func (tree *BTree) minFill() int {
+	return tree.cfg.minFill
+}
+
+// compare 2 keys in the order of the tree, the empty sentinel key is the minimum
+func (tree *BTree) compare(a []byte, b []byte) int {
+	if len(a) == 0 || len(b) == 0 {
+		return min(len(a), 1) - min(len(b), 1)
+	}
+	return tree.cfg.compare(a, b)
+}
+
+// the inline prefix of a large key, the reference to the tail follows it
+func (tree *BTree) keyPrefixSize() int {
+	return tree.cfg.maxKeySize - OVERFLOW_REF_SIZE
+}
+
+// the number of data bytes an overflow page holds
+func (tree *BTree) overflowDataSize() int {
+	return tree.cfg.pageSize - OVERFLOW_HEADER
+}
@@ -0,0 +1,106 @@
+package btree
+
+import (
+	"encoding/binary"
+)
+
+// the value of a kid link, the number of keys in the kid
+func countValue(count uint64) []byte {
+	return binary.LittleEndian.AppendUint64(nil, count)
+}
+
+// the number of keys in the subtree of a kid
+func (node BNode) kidCount(idx uint16) uint64 {
+	return binary.LittleEndian.Uint64(node.getValue(idx))
+}
+
+// the number of keys in the subtree of the node, the sentinel key not counted
+func nodeCount(node BNode) uint64 {
+	if node.btype() == BNODE_NODE {
+		count := uint64(0)
+		for i := uint16(0); i < node.nkeys(); i++ {
+			count += node.kidCount(i)
+		}
+		return count
+	}
+	return uint64(node.nkeys() - leafKeysBefore(node, node.nkeys()))
+}
+
+// the number of sentinel keys before the position of a leaf, 0 or 1
+func leafKeysBefore(node BNode, idx uint16) uint16 {
+	if idx > 0 && len(node.getKey(0)) == 0 {
+		return 1
+	}
+	return 0
+}
+
+// the number of keys that are less than the key
+func (tree *BTree) Rank(key []byte) uint64 {
+	rank := uint64(0)
+	for ptr := tree.root; ptr != 0; {
+		node := tree.get(ptr)
+		idx := nodeLookupLE(tree, node, key)
+		switch node.btype() {
+		case BNODE_LEAF:
+			if tree.compareKey(node, idx, key) < 0 {
+				idx++ // node.getKey(idx) < key
+			}
+			rank += uint64(idx - leafKeysBefore(node, idx))
+			ptr = 0
+		case BNODE_NODE:
+			for i := uint16(0); i < idx; i++ {
+				rank += node.kidCount(i)
+			}
+			ptr = node.getPtr(idx)
+		default:
+			panic("bad node!")
+		}
+	}
+	return rank
+}
+
+// the number of keys in [start, end), a nil start or end leaves that
+// side of the range unbounded
+func (tree *BTree) Count(start []byte, end []byte) uint64 {
+	if tree.root == 0 {
+		return 0
+	}
+	total := nodeCount(tree.get(tree.root))
+	if end != nil {
+		total = tree.Rank(end)
+	}
+	if start != nil {
+		total -= min(total, tree.Rank(start))
+	}
+	return total
+}
+
+// an iterator at the n-th key in sorted order, counting from 0.
+// the iterator is not valid if there are not as many keys.
+func (tree *BTree) Nth(n uint64) *BIter {
+	if n >= tree.Count(nil, nil) {
+		iter := tree.seekLast()
+		iter.Next() // past the last key
+		return iter
+	}
+	iter := &BIter{tree: tree}
+	for ptr := tree.root; ptr != 0; {
+		node := tree.get(ptr)
+		idx := uint16(0)
+		switch node.btype() {
+		case BNODE_LEAF:
+			idx = uint16(n) + leafKeysBefore(node, node.nkeys())
+			ptr = 0
+		case BNODE_NODE:
+			for ; idx+1 < node.nkeys() && n >= node.kidCount(idx); idx++ {
+				n -= node.kidCount(idx)
+			}
+			ptr = node.getPtr(idx)
+		default:
+			panic("bad node!")
+		}
+		iter.path = append(iter.path, node)
+		iter.pos = append(iter.pos, idx)
+	}
+	return iter
+}
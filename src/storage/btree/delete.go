@@ -1,8 +1,6 @@
 package btree
 
 import (
-	"bytes"
-
 	"github.com/harish876/scratchdb/src/utils"
 )
 
@@ -13,7 +11,7 @@ func leafDelete(new BNode, old BNode, idx uint16) {
 	nodeAppendRange(new, old, idx, idx+1, old.nkeys()-idx-1)
 }
 
-// sizeof(merge(left, right)) <= BTREE_PAGE_SIZE, this condition
+// sizeof(merge(left, right)) <= page size, this condition
 // must be checked by the caller
 func nodeMerge(merged BNode, left BNode, right BNode) {
 	utils.Assert(left.btype() == right.btype())
@@ -25,86 +23,338 @@ func nodeMerge(merged BNode, left BNode, right BNode) {
 // replace 2 adjacent links with 1
 func nodeReplace2Kid(
 	new BNode, old BNode, idx uint16,
-	ptr uint64, key []byte,
+	ptr uint64, merged BNode,
 ) {
 	new.setHeader(BNODE_NODE, old.nkeys()-1)
 	nodeAppendRange(new, old, 0, 0, idx)
-	nodeAppendKV(new, idx, ptr, key, nil)
+	nodeAppendKid(new, idx, ptr, merged)
 	nodeAppendRange(new, old, idx+1, idx+2, old.nkeys()-(idx+2))
 }
 
+// replace 2 adjacent links with the redistributed kids
+func nodeReplace2KidN(tree *BTree, new BNode, old BNode, idx uint16, kids ...BNode) {
+	new.setHeader(BNODE_NODE, old.nkeys()-2+uint16(len(kids)))
+	nodeAppendRange(new, old, 0, 0, idx)
+	for i, link := range tree.linkKids(kids, tree.newNode) {
+		nodeAppendKVFlags(new, idx+uint16(i), link.ptr, link.key, link.val, link.kflag, 0)
+	}
+	nodeAppendRange(new, old, idx+uint16(len(kids)), idx+2, old.nkeys()-(idx+2))
+}
+
 // delete a key from the tree
-func treeDelete(tree *BTree, node BNode, key []byte) BNode {
-	idx := nodeLookupLE(node, key)
-	switch node.btype() {
-	case BNODE_LEAF:
-		if !bytes.Equal(key, node.getKey(idx)) {
-			return BNode{} // key does not exist
-		}
-		new := BNode(make([]byte, BTREE_PAGE_SIZE))
-		leafDelete(new, node, idx)
-		return new
-	case BNODE_NODE:
+func treeDelete(tree *BTree, node BNode, key []byte) (BNode, error) {
+	if err := checkNode(node); err != nil {
+		return BNode{}, err
+	}
+	idx := nodeLookupLE(tree, node, key)
+	if node.btype() == BNODE_NODE {
 		return nodeDelete(tree, node, idx, key)
-	default:
-		panic("unknown BNode type")
 	}
+	if tree.compareKey(node, idx, key) != 0 {
+		return BNode{}, nil // key does not exist
+	}
+	tree.freePages(tree.kvPages(node, idx))
+	new := newTempNode(node.rawBytes())
+	leafDelete(new, node, idx)
+	return new, nil
 }
 
 // should the updated kid be merged with a sibling?
+// returns the direction of the sibling, and whether they fit into a page,
+// if they don't, the KVs are redistributed between them.
 func shouldMerge(
 	tree *BTree, node BNode,
 	idx uint16, updated BNode,
-) (int, BNode) {
-	if updated.nbytes() > BTREE_PAGE_SIZE/4 {
-		return 0, BNode{}
+) (int, BNode, bool) {
+	if tree.encodedSize(updated, 0, updated.nkeys()) >= tree.minFill() {
+		return 0, BNode{}, false
 	}
 
 	if idx > 0 {
 		sibling := BNode(tree.get(node.getPtr(idx - 1)))
-		merged := sibling.nbytes() + updated.nbytes() - HEADER
-		if merged <= BTREE_PAGE_SIZE {
-			return -1, sibling // left
+		if tree.mergedSize(sibling, updated) <= tree.pageSize() {
+			return -1, sibling, true // left
 		}
 	}
 	if idx+1 < node.nkeys() {
 		sibling := BNode(tree.get(node.getPtr(idx + 1)))
-		merged := sibling.nbytes() + updated.nbytes() - HEADER
-		if merged <= BTREE_PAGE_SIZE {
-			return +1, sibling // right
+		if tree.mergedSize(updated, sibling) <= tree.pageSize() {
+			return +1, sibling, true // right
+		}
+	}
+	// too big to merge, take some KVs from a sibling instead
+	if idx > 0 {
+		return -1, tree.get(node.getPtr(idx - 1)), false
+	}
+	if idx+1 < node.nkeys() {
+		return +1, tree.get(node.getPtr(idx + 1)), false
+	}
+	return 0, BNode{}, false
+}
+
+// move KVs between 2 adjacent nodes that don't fit into a page together,
+// so that both of them are about half full
+func nodeRedistribute(tree *BTree, left BNode, right BNode) [2]BNode {
+	merged := newTempNode(left.rawBytes() + right.rawBytes())
+	nodeMerge(merged, left, right)
+	// the most even split where both halves fit
+	nkeys := merged.nkeys()
+	best, diff := uint16(0), 0
+	for i := uint16(1); i < nkeys; i++ {
+		lsize := tree.encodedSize(merged, 0, i)
+		rsize := tree.encodedSize(merged, i, nkeys)
+		if lsize > tree.pageSize() {
+			break
+		}
+		if rsize <= tree.pageSize() && (best == 0 || abs(lsize-rsize) < diff) {
+			best, diff = i, abs(lsize-rsize)
 		}
 	}
-	return 0, BNode{}
+	utils.Assert(best > 0)
+	kids := [2]BNode{newTempNode(merged.rawBytes()), newTempNode(merged.rawBytes())}
+	kids[0].setHeader(merged.btype(), best)
+	nodeAppendRange(kids[0], merged, 0, 0, best)
+	kids[1].setHeader(merged.btype(), nkeys-best)
+	nodeAppendRange(kids[1], merged, 0, best, nkeys-best)
+	return kids
 }
 
-func nodeDelete(tree *BTree, node BNode, idx uint16, key []byte) BNode {
+func abs(x int) int {
+	return max(x, -x)
+}
+
+// the page size of 2 adjacent nodes once they are merged
+func (tree *BTree) mergedSize(left BNode, right BNode) int {
+	if left.nkeys() == 0 || right.nkeys() == 0 {
+		return tree.encodedSize(left, 0, left.nkeys()) + tree.encodedSize(right, 0, right.nkeys()) - HEADER
+	}
+	n := int(left.nkeys() + right.nkeys())
+	size := left.rawBytes() + right.rawBytes() - HEADER
+	if tree.cfg.compress {
+		plen := commonPrefix(left.getKey(0), right.getKey(right.nkeys()-1))
+		plen = min(plen, tree.keyPrefixSize())
+		size += 2 + plen - n*plen
+	}
+	return size
+}
+
+// replace the updated kid and its sibling in the direction from shouldMerge
+// with the merged kid, or with both of them after taking some KVs from the
+// sibling. returns the page of the sibling, which is replaced.
+func nodeMergeKid(
+	tree *BTree, new BNode, node BNode, idx uint16,
+	updated BNode, dir int, sibling BNode, merge bool,
+) uint64 {
+	switch {
+	case dir < 0 && !merge: // take from the left
+		kids := nodeRedistribute(tree, sibling, updated)
+		nodeReplace2KidN(tree, new, node, idx-1, kids[:]...)
+		return node.getPtr(idx - 1)
+	case dir > 0 && !merge: // take from the right
+		kids := nodeRedistribute(tree, updated, sibling)
+		nodeReplace2KidN(tree, new, node, idx, kids[:]...)
+		return node.getPtr(idx + 1)
+	case dir < 0: // left
+		merged := newTempNode(sibling.rawBytes() + updated.rawBytes())
+		nodeMerge(merged, sibling, updated)
+		nodeReplace2Kid(new, node, idx-1, tree.newNode(merged), merged)
+		return node.getPtr(idx - 1)
+	default: // right
+		merged := newTempNode(sibling.rawBytes() + updated.rawBytes())
+		nodeMerge(merged, updated, sibling)
+		nodeReplace2Kid(new, node, idx, tree.newNode(merged), merged)
+		return node.getPtr(idx + 1)
+	}
+}
+
+func nodeDelete(tree *BTree, node BNode, idx uint16, key []byte) (BNode, error) {
 	// recurse into the kid
 	kptr := node.getPtr(idx)
-	updated := treeDelete(tree, tree.get(kptr), key)
-	if len(updated) == 0 {
-		return BNode{} // not found
+	updated, err := treeDelete(tree, tree.get(kptr), key)
+	if err != nil || len(updated) == 0 {
+		return BNode{}, err // not found
 	}
 	tree.del(kptr)
 
-	new := BNode(make([]byte, BTREE_PAGE_SIZE))
+	// the separators might grow, the node might need a split
+	new := newTempNode(node.rawBytes() + tree.pageSize())
 	// check for merging
-	mergeDir, sibling := shouldMerge(tree, node, idx, updated)
+	mergeDir, sibling, merge := shouldMerge(tree, node, idx, updated)
 	switch {
-	case mergeDir < 0: // left
-		merged := BNode(make([]byte, BTREE_PAGE_SIZE))
-		nodeMerge(merged, sibling, updated)
-		tree.del(node.getPtr(idx - 1))
-		nodeReplace2Kid(new, node, idx-1, tree.new(merged), merged.getKey(0))
-	case mergeDir > 0: // right
-		merged := BNode(make([]byte, BTREE_PAGE_SIZE))
-		nodeMerge(merged, updated, sibling)
-		tree.del(node.getPtr(idx + 1))
-		nodeReplace2Kid(new, node, idx, tree.new(merged), merged.getKey(0))
+	case mergeDir != 0:
+		tree.del(nodeMergeKid(tree, new, node, idx, updated, mergeDir, sibling, merge))
 	case mergeDir == 0 && updated.nkeys() == 0:
 		utils.Assert(node.nkeys() == 1 && idx == 0) // 1 empty child but no sibling
 		new.setHeader(BNODE_NODE, 0)                // the parent becomes empty too
 	case mergeDir == 0 && updated.nkeys() > 0: // no merge
-		nodeReplaceKidN(tree, new, node, idx, updated)
+		nsplit, split := nodeSplit3(tree, updated)
+		nodeReplaceKidN(tree, new, node, idx, split[:nsplit]...)
+	}
+	return new, nil
+}
+
+// whether the key at the position is below the exclusive end of a range,
+// a nil end is unbounded
+func keyBefore(tree *BTree, node BNode, idx uint16, end []byte) bool {
+	return end == nil || tree.compareKey(node, idx, end) < 0
+}
+
+// delete the keys in [start, end) from the tree, in a single pass.
+// returns an empty node and 0 if nothing was deleted.
+// the result might be bigger than 1 page or have no keys at all.
+// the replaced kids are collected in freed, to be deallocated by the
+// caller once the whole pass has succeeded.
+func treeDeleteRange(
+	tree *BTree, node BNode, start []byte, end []byte, freed *[]uint64,
+) (BNode, int, error) {
+	if err := checkNode(node); err != nil {
+		return BNode{}, 0, err
+	}
+	if node.btype() == BNODE_NODE {
+		return nodeDeleteRange(tree, node, start, end, freed)
+	}
+	new, deleted := leafDeleteRange(tree, node, start, end, freed)
+	return new, deleted, nil
+}
+
+// remove the keys in [start, end) from a leaf node
+func leafDeleteRange(
+	tree *BTree, node BNode, start []byte, end []byte, freed *[]uint64,
+) (BNode, int) {
+	nkeys := node.nkeys()
+	// the first key to delete, never the sentinel key
+	lo := nodeLookupLE(tree, node, start)
+	for lo < nkeys && (len(node.getKey(lo)) == 0 || tree.compareKey(node, lo, start) < 0) {
+		lo++
+	}
+	// one past the last key to delete
+	hi := lo
+	for hi < nkeys && keyBefore(tree, node, hi, end) {
+		hi++
+	}
+	if hi == lo {
+		return BNode{}, 0 // nothing in the range
+	}
+	for i := lo; i < hi; i++ {
+		*freed = append(*freed, tree.kvPages(node, i)...)
+	}
+	new := newTempNode(node.rawBytes())
+	new.setHeader(BNODE_LEAF, nkeys-(hi-lo))
+	nodeAppendRange(new, node, 0, 0, lo)
+	nodeAppendRange(new, node, lo, hi, nkeys-hi)
+	return new, int(hi - lo)
+}
+
+// recurse into every kid that overlaps [start, end) and rebuild the node once
+func nodeDeleteRange(
+	tree *BTree, node BNode, start []byte, end []byte, freed *[]uint64,
+) (BNode, int, error) {
+	nkeys := node.nkeys()
+	entries := make([]kvEntry, 0, nkeys)
+	deleted := 0
+	rebuilt := []int{} // the positions of the rewritten kids in the entries
+	first := nodeLookupLE(tree, node, start)
+	for i := uint16(0); i < nkeys; i++ {
+		kptr := node.getPtr(i)
+		if i < first || !keyBefore(tree, node, i, end) {
+			entries = append(entries, nodeEntry(node, i)) // out of range
+			continue
+		}
+		if kidCovered(tree, node, i, start, end) {
+			// the whole kid is dropped without being rewritten
+			if err := tree.subtreePages(kptr, freed); err != nil {
+				return BNode{}, 0, err
+			}
+			deleted += int(node.kidCount(i))
+			continue
+		}
+		updated, n, err := treeDeleteRange(tree, tree.get(kptr), start, end, freed)
+		if err != nil {
+			return BNode{}, 0, err
+		}
+		if n == 0 {
+			entries = append(entries, nodeEntry(node, i)) // unchanged
+			continue
+		}
+		deleted += n
+		*freed = append(*freed, kptr)
+		if updated.nkeys() == 0 {
+			continue // the kid is gone
+		}
+		// separators might have grown, the kid might need a split
+		nsplit, split := nodeSplit3(tree, updated)
+		if nsplit == 1 {
+			rebuilt = append(rebuilt, len(entries))
+		}
+		entries = append(entries, tree.linkKids(split[:nsplit], tree.newNode)...)
+	}
+	if deleted == 0 {
+		return BNode{}, 0, nil
+	}
+	new := newTempNode(HEADER + runSize(entries))
+	nodeBuild(new, BNODE_NODE, entries)
+
+	// the boundary kids might be left almost empty, merge them with a sibling
+	// like a single delete does. from the right, so that the positions on the
+	// left stay the same.
+	for i := len(rebuilt) - 1; i >= 0; i-- {
+		idx := uint16(rebuilt[i])
+		kptr := new.getPtr(idx)
+		kid := tree.get(kptr)
+		dir, sibling, merge := shouldMerge(tree, new, idx, kid)
+		if dir == 0 {
+			continue
+		}
+		node := new
+		new = newTempNode(node.rawBytes() + tree.pageSize())
+		*freed = append(*freed, kptr, nodeMergeKid(tree, new, node, idx, kid, dir, sibling, merge))
+	}
+	return new, deleted, nil
+}
+
+// whether every key of the kid is in [start, end).
+// the first kid has the sentinel key, which is never deleted.
+func kidCovered(tree *BTree, node BNode, idx uint16, start []byte, end []byte) bool {
+	if idx == 0 || tree.compareKey(node, idx, start) < 0 {
+		return false
+	}
+	if end == nil {
+		return true
+	}
+	// the kid's keys are below the next separator,
+	// the upper bound of the last kid is not known here
+	return idx+1 < node.nkeys() && tree.compareKey(node, idx+1, end) <= 0
+}
+
+// collect every page of a subtree, including the overflow pages of its
+// leaves, to be deallocated by the caller. the pages are checked but not rewritten.
+func (tree *BTree) subtreePages(ptr uint64, freed *[]uint64) error {
+	node := tree.get(ptr)
+	if err := checkNode(node); err != nil {
+		return err
+	}
+	for i := uint16(0); i < node.nkeys(); i++ {
+		if node.btype() == BNODE_NODE {
+			if err := tree.subtreePages(node.getPtr(i), freed); err != nil {
+				return err
+			}
+		} else {
+			*freed = append(*freed, tree.kvPages(node, i)...)
+		}
+	}
+	*freed = append(*freed, ptr)
+	return nil
+}
+
+// free every page of a subtree, including the overflow pages of its leaves
+func (tree *BTree) freeSubtree(ptr uint64) {
+	node := tree.get(ptr)
+	for i := uint16(0); i < node.nkeys(); i++ {
+		if node.btype() == BNODE_NODE {
+			tree.freeSubtree(node.getPtr(i))
+		} else {
+			tree.freePages(tree.kvPages(node, i))
+		}
 	}
-	return new
+	tree.del(ptr)
 }
@@ -0,0 +1,70 @@
+package btree
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+)
+
+var (
+	ErrEmptyKey      = errors.New("btree: empty key")
+	ErrKeyTooLarge   = errors.New("btree: key too large")
+	ErrValueTooLarge = errors.New("btree: value too large")
+	ErrCorruptPage   = errors.New("btree: corrupt page")
+	ErrNotEmpty      = errors.New("btree: tree is not empty")
+	ErrUnsorted      = errors.New("btree: keys are not sorted")
+	ErrReadOnly      = errors.New("btree: read-only page store")
+	ErrDoubleFree    = errors.New("btree: page freed twice")
+
+	ErrInvalidOptions = errors.New("btree: invalid options")
+)
+
+// validate the user input of an update
+func checkKV(key []byte, val []byte) error {
+	if len(key) == 0 {
+		return ErrEmptyKey
+	}
+	if len(key) > BTREE_MAX_OVERFLOW_SIZE {
+		return ErrKeyTooLarge
+	}
+	if len(val) > BTREE_MAX_OVERFLOW_SIZE {
+		return ErrValueTooLarge
+	}
+	return nil
+}
+
+// validate a page read from storage, the header and the offsets of every KV,
+// so that a bad page is reported instead of crashing the node accessors.
+// only the update paths check their pages. the read paths (Get, the
+// iterators, Rank, Count and Nth) and the overflow chains panic on a corrupt
+// page, Check() verifies a whole tree up front.
+func checkNode(node BNode) error {
+	if len(node) < HEADER {
+		return fmt.Errorf("%w: short page of %d bytes", ErrCorruptPage, len(node))
+	}
+	switch node.btype() {
+	case BNODE_NODE, BNODE_LEAF:
+	default:
+		return fmt.Errorf("%w: bad node type %d", ErrCorruptPage, node.btype())
+	}
+	if node.hasPrefix() && (len(node) < HEADER+2 || node.headerSize() > len(node)) {
+		return fmt.Errorf("%w: bad key prefix", ErrCorruptPage)
+	}
+	nkeys := node.nkeys()
+	if node.headerSize()+(8+node.offsetSize())*int(nkeys) > len(node) {
+		return fmt.Errorf("%w: %d keys do not fit in a page", ErrCorruptPage, nkeys)
+	}
+	// the offsets must match the KV lengths
+	for i := uint16(0); i < nkeys; i++ {
+		begin, end := node.kvPos(i), node.kvPos(i+1)
+		if begin+4 > end || end > len(node) {
+			return fmt.Errorf("%w: bad offset of KV %d", ErrCorruptPage, i)
+		}
+		klen := binary.LittleEndian.Uint16(node[begin:]) &^ BTREE_LEN_OVERFLOW
+		vlen := binary.LittleEndian.Uint16(node[begin+2:]) &^ BTREE_LEN_OVERFLOW
+		if begin+4+int(klen)+int(vlen) != end {
+			return fmt.Errorf("%w: the size of KV %d does not match the offsets", ErrCorruptPage, i)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,21 @@
+package btree
+
+// look up a key starting from the node, the node's subtree must contain the key
+func treeGet(tree *BTree, node BNode, key []byte) ([]byte, bool) {
+	for {
+		idx := nodeLookupLE(tree, node, key)
+		switch node.btype() {
+		case BNODE_LEAF:
+			// leaf, node.getKey(idx) <= key
+			if tree.compareKey(node, idx, key) != 0 {
+				return nil, false // key does not exist
+			}
+			return tree.readValue(node, idx), true
+		case BNODE_NODE:
+			// internal node, descend into the kid covering the key
+			node = tree.get(node.getPtr(idx))
+		default:
+			panic("bad node!")
+		}
+	}
+}
@@ -14,38 +14,35 @@ func nodeReplaceKidN(
 	inc := uint16(len(kids))
 	new.setHeader(BNODE_NODE, old.nkeys()+inc-1)
 	nodeAppendRange(new, old, 0, 0, idx)
-	for i, node := range kids {
-		nodeAppendKV(new, idx+uint16(i), tree.new(node), node.getKey(0), nil)
-		//                ^position      ^pointer        ^key            ^val
+	for i, link := range tree.linkKids(kids, tree.newNode) {
+		// the separator is from the kid, it might be truncated after a leaf
+		nodeAppendKVFlags(new, idx+uint16(i), link.ptr, link.key, link.val, link.kflag, 0)
 	}
 	nodeAppendRange(new, old, idx+inc, idx+1, old.nkeys()-(idx+1))
 }
 
 // splits from idx to end, determine if it could be fit into a page
-func splitFromIdxFitInOnePage(node BNode, idx uint16) bool {
+func splitFromIdxFitInOnePage(tree *BTree, node BNode, idx uint16) bool {
 	utils.Assert(idx < node.nkeys())
-
-	nkeys := node.nkeys() - idx
-	kvSize := node.nbytes() - node.kvPos(idx)
-	return (HEADER + nkeys*8 + nkeys*2 + kvSize) <= BTREE_PAGE_SIZE
+	return tree.encodedSize(node, idx, node.nkeys()) <= tree.pageSize()
 }
 
 // split a bigger-than-allowed node into two.
 // the second node always fits on a page
-func nodeSplit2(left BNode, right BNode, old BNode) {
-	// binary search on old node to find the biggest kvPos < BTREE_PAGE_SIZE
+func nodeSplit2(tree *BTree, left BNode, right BNode, old BNode) {
+	// binary search on old node to find the biggest kvPos < pageSize
 	l := uint16(0)
 	r := old.nkeys() - 1
 	for l+1 < r {
 		m := (l + r) / 2
-		if splitFromIdxFitInOnePage(old, m) {
+		if splitFromIdxFitInOnePage(tree, old, m) {
 			r = m
 		} else {
 			l = m
 		}
 	}
 	var startIdx uint16
-	if splitFromIdxFitInOnePage(old, l) {
+	if splitFromIdxFitInOnePage(tree, old, l) {
 		startIdx = l
 	} else {
 		startIdx = r
@@ -58,82 +55,136 @@ func nodeSplit2(left BNode, right BNode, old BNode) {
 	nodeAppendRange(right, old, 0, startIdx, old.nkeys()-startIdx)
 }
 
-// split a node if it's too big. the results are 1~3 nodes.
-func nodeSplit3(old BNode) (uint16, [3]BNode) {
-	if old.nbytes() <= BTREE_PAGE_SIZE {
-		old = old[:BTREE_PAGE_SIZE]
+// trim a node that fits into a page to the page size.
+// a node bigger than 64K has wider offsets and a temporary node might be
+// smaller than a page, so they are copied instead.
+func nodeFit(node BNode, pageSize int) BNode {
+	if node.offsetSize() == 2 && len(node) >= pageSize {
+		return node[:pageSize]
+	}
+	fit := BNode(make([]byte, pageSize))
+	fit.setHeader(node.btype(), node.nkeys())
+	nodeAppendRange(fit, node, 0, 0, node.nkeys())
+	return fit
+}
+
+// split a node if it's too big. the results are 1~3 nodes that fit
+// into a page once they are encoded by tree.newNode().
+func nodeSplit3(tree *BTree, old BNode) (uint16, [3]BNode) {
+	pageSize := tree.pageSize()
+	if tree.encodedSize(old, 0, old.nkeys()) <= pageSize {
 		return 1, [3]BNode{old} // not split
 	}
-	left := BNode(make([]byte, 2*BTREE_PAGE_SIZE)) // might be split later
-	right := BNode(make([]byte, BTREE_PAGE_SIZE))
-	nodeSplit2(left, right, old)
-	if left.nbytes() <= BTREE_PAGE_SIZE {
-		left = left[:BTREE_PAGE_SIZE]
+	left := newTempNode(old.rawBytes()) // might be split later
+	right := newTempNode(old.rawBytes())
+	nodeSplit2(tree, left, right, old)
+	if tree.encodedSize(left, 0, left.nkeys()) <= pageSize {
 		return 2, [3]BNode{left, right} // 2 nodes
 	}
-	leftleft := BNode(make([]byte, BTREE_PAGE_SIZE))
-	middle := BNode(make([]byte, BTREE_PAGE_SIZE))
-	nodeSplit2(leftleft, middle, left)
-	utils.Assert(leftleft.nbytes() <= BTREE_PAGE_SIZE)
+	leftleft := newTempNode(left.rawBytes())
+	middle := newTempNode(left.rawBytes())
+	nodeSplit2(tree, leftleft, middle, left)
+	utils.Assert(tree.encodedSize(leftleft, 0, leftleft.nkeys()) <= pageSize)
 	return 3, [3]BNode{leftleft, middle, right} // 3 nodes
 }
 
 // part of the treeInsert(): KV insertion to an internal node
 func nodeInsert(
-	tree *BTree, new BNode, node BNode, idx uint16,
-	key []byte, val []byte,
-) {
+	tree *BTree, req *InsertReq, new BNode, node BNode, idx uint16,
+) (bool, error) {
 	kptr := node.getPtr(idx)
 	// recursive insertion to the kid node
-	knode := treeInsert(tree, tree.get(kptr), key, val)
+	knode, err := treeInsert(tree, req, tree.get(kptr))
+	if err != nil || len(knode) == 0 {
+		return false, err // not updated
+	}
 	// split the result
-	nsplit, split := nodeSplit3(knode)
+	nsplit, split := nodeSplit3(tree, knode)
 	// deallocate the kid node
 	tree.del(kptr)
 	// update the kid links
 	nodeReplaceKidN(tree, new, node, idx, split[:nsplit]...)
+	return true, nil
 }
 
-func leafInsert(new BNode, old BNode, idx uint16, key, value []byte) {
+func leafInsert(new BNode, old BNode, idx uint16, key, value []byte, kflag, vflag uint16) {
 	new.setHeader(BNODE_LEAF, old.nkeys()+1)
 	nodeAppendRange(new, old, 0, 0, idx)
-	nodeAppendKV(new, idx, 0, key, value)
+	nodeAppendKVFlags(new, idx, 0, key, value, kflag, vflag)
 	nodeAppendRange(new, old, idx+1, idx, old.nkeys()-idx)
 }
 
-func leafUpdate(new BNode, old BNode, idx uint16, key, value []byte) {
+// update the value of a KV, the key keeps its inline bytes and overflow pages
+func leafUpdate(new BNode, old BNode, idx uint16, value []byte, vflag uint16) {
 	new.setHeader(BNODE_LEAF, old.nkeys())
 	nodeAppendRange(new, old, 0, 0, idx)
-	nodeAppendKV(new, idx, 0, key, value)
+	nodeAppendKVFlags(new, idx, 0, old.getKey(idx), value, old.keyFlag(idx), vflag)
 	nodeAppendRange(new, old, idx+1, idx+1, old.nkeys()-idx-1)
 }
 
+// part of the treeInsert(): KV insertion to a leaf node, node.getKey(idx) <= key
+// unless a truncated separator led to a key before the first key of the leaf.
+func leafUpsert(tree *BTree, req *InsertReq, new BNode, node BNode, idx uint16) bool {
+	cmp := tree.compareKey(node, idx, req.Key)
+	if cmp == 0 {
+		// found the key
+		old := tree.readValue(node, idx)
+		req.Old = append([]byte{}, old...)
+		if req.Mode == MODE_INSERT_ONLY || bytes.Equal(old, req.Val) {
+			return false
+		}
+		if req.cas && !bytes.Equal(old, req.expected) {
+			return false
+		}
+		// update it and free the old value
+		storedVal, vflag := tree.storeValue(req.Val)
+		tree.freePages(tree.valuePages(node, idx))
+		leafUpdate(new, node, idx, storedVal, vflag)
+	} else {
+		if req.Mode == MODE_UPDATE_ONLY {
+			return false
+		}
+		// insert it after the position
+		if cmp < 0 {
+			idx++
+		}
+		stored, kflag := tree.storeKey(req.Key)
+		storedVal, vflag := tree.storeValue(req.Val)
+		leafInsert(new, node, idx, stored, storedVal, kflag, vflag)
+		req.Added = true
+	}
+	req.Updated = true
+	return true
+}
+
 // insert a KV into a node, the result might be split.
 // the caller is responsible for deallocating the input node
 // and splitting and allocating result nodes.
-func treeInsert(tree *BTree, node BNode, key []byte, val []byte) BNode {
+// returns an empty node if the tree is not updated.
+func treeInsert(tree *BTree, req *InsertReq, node BNode) (BNode, error) {
+	if err := checkNode(node); err != nil {
+		return BNode{}, err
+	}
 	// the result node.
 	// it's allowed to be bigger than 1 page and will be split if so
-	new := BNode(make([]byte, 2*BTREE_PAGE_SIZE))
+	new := newTempNode(node.rawBytes() + tree.pageSize())
 
 	// where to insert the key?
-	idx := nodeLookupLE(node, key)
+	idx := nodeLookupLE(tree, node, req.Key)
 	// act depending on the node type
+	updated := false
 	switch node.btype() {
 	case BNODE_LEAF:
-		// leaf, node.getKey(idx) <= key
-		if bytes.Equal(key, node.getKey(idx)) {
-			// found the key, update it.
-			leafUpdate(new, node, idx, key, val)
-		} else {
-			// insert it after the position.
-			leafInsert(new, node, idx+1, key, val)
-		}
+		updated = leafUpsert(tree, req, new, node, idx)
 	case BNODE_NODE:
 		// internal node, insert it to a kid node.
-		nodeInsert(tree, new, node, idx, key, val)
-	default:
-		panic("bad node!")
+		var err error
+		if updated, err = nodeInsert(tree, req, new, node, idx); err != nil {
+			return BNode{}, err
+		}
+	}
+	if !updated {
+		return BNode{}, nil
 	}
-	return new
+	return new, nil
 }
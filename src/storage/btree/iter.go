@@ -0,0 +1,160 @@
+package btree
+
+import (
+	"github.com/harish876/scratchdb/src/utils"
+)
+
+// BIter is a cursor over the B+tree keys in sorted order.
+// it is invalidated by any update to the tree.
+type BIter struct {
+	tree *BTree
+	path []BNode  // from root to leaf
+	pos  []uint16 // indexes into nodes
+}
+
+// find the closest position that is less or equal to the input key
+func (tree *BTree) seekLE(key []byte) *BIter {
+	iter := &BIter{tree: tree}
+	if tree.root == 0 {
+		return iter // the tree is empty
+	}
+	for ptr := tree.root; ptr != 0; {
+		node := tree.get(ptr)
+		idx := nodeLookupLE(tree, node, key)
+		iter.path = append(iter.path, node)
+		iter.pos = append(iter.pos, idx)
+		switch node.btype() {
+		case BNODE_LEAF:
+			ptr = 0
+		case BNODE_NODE:
+			ptr = node.getPtr(idx)
+		default:
+			panic("bad node!")
+		}
+	}
+	// a truncated separator might lead to the first key of a leaf that is
+	// greater than the key, the key is then after the last key of the left leaf
+	leaf := len(iter.path) - 1
+	if tree.compareKey(iter.path[leaf], iter.pos[leaf], key) > 0 {
+		iter.Prev()
+	}
+	return iter
+}
+
+// position at the last key of the tree
+func (tree *BTree) seekLast() *BIter {
+	iter := &BIter{tree: tree}
+	for ptr := tree.root; ptr != 0; {
+		node := tree.get(ptr)
+		idx := node.nkeys() - 1
+		iter.path = append(iter.path, node)
+		iter.pos = append(iter.pos, idx)
+		switch node.btype() {
+		case BNODE_LEAF:
+			ptr = 0
+		case BNODE_NODE:
+			ptr = node.getPtr(idx)
+		default:
+			panic("bad node!")
+		}
+	}
+	return iter
+}
+
+// Seek returns an iterator positioned at the first key that is
+// greater or equal to the input key.
+func (tree *BTree) Seek(key []byte) *BIter {
+	iter := tree.seekLE(key)
+	if !iter.Valid() || tree.compare(iter.Key(), key) < 0 {
+		iter.Next()
+	}
+	return iter
+}
+
+// the iterator is at the sentinel key, i.e. before the first key
+func (iter *BIter) atSentinel() bool {
+	for _, pos := range iter.pos {
+		if pos != 0 {
+			return false
+		}
+	}
+	return true
+}
+
+// the iterator is after the last key
+func (iter *BIter) atEnd() bool {
+	leaf := len(iter.path) - 1
+	return iter.pos[leaf] >= iter.path[leaf].nkeys()
+}
+
+// whether the iterator points to a key
+func (iter *BIter) Valid() bool {
+	return len(iter.path) > 0 && !iter.atEnd() && !iter.atSentinel()
+}
+
+// the current key, the iterator must be valid
+func (iter *BIter) Key() []byte {
+	utils.Assert(iter.Valid(), "Assertion failed at BIter.Key")
+	leaf := len(iter.path) - 1
+	return iter.tree.readKey(iter.path[leaf], iter.pos[leaf])
+}
+
+// the current value, the iterator must be valid
+func (iter *BIter) Value() []byte {
+	utils.Assert(iter.Valid(), "Assertion failed at BIter.Value")
+	leaf := len(iter.path) - 1
+	return iter.tree.readValue(iter.path[leaf], iter.pos[leaf])
+}
+
+// move the node at the level to its next key, returns false at the end of the tree
+func iterNext(iter *BIter, level int) bool {
+	if iter.pos[level]+1 < iter.path[level].nkeys() {
+		iter.pos[level]++ // move within this node
+	} else if level == 0 || !iterNext(iter, level-1) {
+		return false // no more keys
+	} else {
+		// the parent moved, start from the first key of the new kid
+		iter.path[level] = iter.tree.get(iter.path[level-1].getPtr(iter.pos[level-1]))
+		iter.pos[level] = 0
+	}
+	return true
+}
+
+// move the node at the level to its previous key, returns false at the start of the tree
+func iterPrev(iter *BIter, level int) bool {
+	if iter.pos[level] > 0 {
+		iter.pos[level]-- // move within this node
+	} else if level == 0 || !iterPrev(iter, level-1) {
+		return false // no more keys
+	} else {
+		// the parent moved, start from the last key of the new kid
+		kid := iter.tree.get(iter.path[level-1].getPtr(iter.pos[level-1]))
+		iter.path[level] = kid
+		iter.pos[level] = kid.nkeys() - 1
+	}
+	return true
+}
+
+// move to the next key, past the last key the iterator becomes invalid
+func (iter *BIter) Next() {
+	if len(iter.path) == 0 || iter.atEnd() {
+		return
+	}
+	leaf := len(iter.path) - 1
+	if !iterNext(iter, leaf) {
+		iter.pos[leaf] = iter.path[leaf].nkeys() // past the last key
+	}
+}
+
+// move to the previous key, before the first key the iterator becomes invalid
+func (iter *BIter) Prev() {
+	if len(iter.path) == 0 || iter.atSentinel() {
+		return
+	}
+	leaf := len(iter.path) - 1
+	if iter.atEnd() {
+		iter.pos[leaf] = iter.path[leaf].nkeys() - 1 // back to the last key
+		return
+	}
+	iterPrev(iter, leaf) // stops at the sentinel at worst
+}
@@ -0,0 +1,97 @@
+package btree
+
+import (
+	"fmt"
+	"sort"
+	"sync"
+)
+
+// MemStore is a PageStore in memory. pages are numbered from 1 in the
+// order they are allocated and the numbers are not reused.
+// a free of a page that is not allocated, or a read of one, panics.
+// it can be read while it's updated.
+type MemStore struct {
+	mu       sync.RWMutex
+	pages    map[uint64][]byte
+	next     uint64 // the number of the next page
+	allocs   uint64 // the number of allocations so far
+	readOnly bool
+}
+
+func NewMemStore() *MemStore {
+	return &MemStore{pages: map[uint64][]byte{}, next: 1}
+}
+
+// read a page, the page must not be modified
+func (s *MemStore) Get(ptr uint64) []byte {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	page, ok := s.pages[ptr]
+	if !ok {
+		panic(fmt.Errorf("%w: page %d is not allocated", ErrCorruptPage, ptr))
+	}
+	return page
+}
+
+// keep a new page, the store takes the slice
+func (s *MemStore) Allocate(page []byte) uint64 {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	ptr := s.next
+	s.next++
+	s.allocs++
+	s.pages[ptr] = page
+	return ptr
+}
+
+// deallocate a page
+func (s *MemStore) Free(ptr uint64) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if _, ok := s.pages[ptr]; !ok {
+		panic(fmt.Errorf("%w: page %d", ErrDoubleFree, ptr))
+	}
+	delete(s.pages, ptr)
+}
+
+func (s *MemStore) ReadOnly() bool {
+	return s.readOnly
+}
+
+// reject or allow updates to the trees on the store
+func (s *MemStore) SetReadOnly(readOnly bool) {
+	s.readOnly = readOnly
+}
+
+// the number of allocated pages
+func (s *MemStore) Live() int {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return len(s.pages)
+}
+
+// the number of allocations since the store is created
+func (s *MemStore) Allocations() uint64 {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return s.allocs
+}
+
+// the allocated pages that are not reachable from the root of the tree,
+// in order. the tree must be the only one on the store, without snapshots.
+func (s *MemStore) Leaks(tree *BTree) ([]uint64, error) {
+	reachable, err := tree.reachable()
+	if err != nil {
+		return nil, err
+	}
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	leaks := []uint64{}
+	for ptr := range s.pages {
+		if !reachable[ptr] {
+			leaks = append(leaks, ptr)
+		}
+	}
+	sort.Slice(leaks, func(i, j int) bool { return leaks[i] < leaks[j] })
+	return leaks, nil
+}
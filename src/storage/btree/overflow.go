@@ -0,0 +1,175 @@
+package btree
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+)
+
+// the header of an overflow page: type, unused, next page
+const OVERFLOW_HEADER = HEADER + 8
+
+// the inline reference to an overflow chain: total length, first page
+const OVERFLOW_REF_SIZE = 4 + 8
+
+func (node BNode) overflowNext() uint64 {
+	return binary.LittleEndian.Uint64(node[HEADER:])
+}
+
+// write the data into a chain of overflow pages and return the reference to it.
+// the data is a large value or the tail of a large key.
+func (tree *BTree) newOverflow(data []byte) []byte {
+	// allocate from the tail so that each page can point to the next one
+	next := uint64(0)
+	per := tree.overflowDataSize()
+	for n := (len(data) + per - 1) / per; n > 0; n-- {
+		page := BNode(make([]byte, tree.pageSize()))
+		page.setHeader(BNODE_OVERFLOW, 0)
+		binary.LittleEndian.PutUint64(page[HEADER:], next)
+		copy(page[OVERFLOW_HEADER:], data[(n-1)*per:])
+		next = tree.new(page)
+	}
+	ref := make([]byte, OVERFLOW_REF_SIZE)
+	binary.LittleEndian.PutUint32(ref[0:4], uint32(len(data)))
+	binary.LittleEndian.PutUint64(ref[4:12], next)
+	return ref
+}
+
+// read the whole data of an overflow chain
+func (tree *BTree) readOverflow(ref []byte) []byte {
+	size := int(binary.LittleEndian.Uint32(ref[0:4]))
+	ptr := binary.LittleEndian.Uint64(ref[4:12])
+	data := make([]byte, 0, size)
+	for len(data) < size {
+		page := tree.get(ptr)
+		if page.btype() != BNODE_OVERFLOW {
+			panic(fmt.Errorf("%w: bad overflow page type %d", ErrCorruptPage, page.btype()))
+		}
+		n := min(size-len(data), tree.overflowDataSize())
+		data = append(data, page[OVERFLOW_HEADER:][:n]...)
+		ptr = page.overflowNext()
+	}
+	return data
+}
+
+// the pages of an overflow chain
+func (tree *BTree) overflowPages(ref []byte) []uint64 {
+	size := int(binary.LittleEndian.Uint32(ref[0:4]))
+	ptr := binary.LittleEndian.Uint64(ref[4:12])
+	pages := []uint64{}
+	for read := 0; read < size; read += tree.overflowDataSize() {
+		pages = append(pages, ptr)
+		ptr = tree.get(ptr).overflowNext()
+	}
+	return pages
+}
+
+// the inline bytes and the vlen flag of a value to be stored in a leaf.
+// large values are written to overflow pages.
+func (tree *BTree) storeValue(val []byte) ([]byte, uint16) {
+	if len(val) <= tree.maxValSize() {
+		return val, 0
+	}
+	return tree.newOverflow(val), BTREE_LEN_OVERFLOW
+}
+
+// the inline bytes and the klen flag of a key to be stored in a leaf.
+// large keys keep a prefix inline and the tail is written to overflow pages.
+func (tree *BTree) storeKey(key []byte) ([]byte, uint16) {
+	if len(key) <= tree.maxKeySize() {
+		return key, 0
+	}
+	prefix := tree.keyPrefixSize()
+	stored := append([]byte{}, key[:prefix]...)
+	stored = append(stored, tree.newOverflow(key[prefix:])...)
+	return stored, BTREE_LEN_OVERFLOW
+}
+
+// the value of a leaf KV, read from the overflow pages if needed
+func (tree *BTree) readValue(node BNode, idx uint16) []byte {
+	if node.isValueRef(idx) {
+		return tree.readOverflow(node.getValue(idx))
+	}
+	return node.getValue(idx)
+}
+
+// the whole key, read from the overflow pages if needed
+func (tree *BTree) readKey(node BNode, idx uint16) []byte {
+	stored := node.getKey(idx)
+	if !node.isKeyRef(idx) {
+		return stored
+	}
+	prefix := tree.keyPrefixSize()
+	key := append([]byte{}, stored[:prefix]...)
+	return append(key, tree.readOverflow(stored[prefix:])...)
+}
+
+// compare the key at the position with the input key, in the order of the tree.
+// the tail of a large key is only read if the inline prefix is not enough.
+func (tree *BTree) compareKey(node BNode, idx uint16, key []byte) int {
+	if prefix := node.prefix(); len(prefix) > 0 && !node.isKeyRef(idx) {
+		// compare with the shared prefix, then with the rest of the key
+		head := key[:min(len(key), len(prefix))]
+		if cmp := bytes.Compare(prefix, head); cmp != 0 {
+			return cmp
+		}
+		if len(key) < len(prefix) {
+			return +1 // the input key is a prefix of the stored key
+		}
+		return bytes.Compare(node.keySuffix(idx), key[len(prefix):])
+	}
+	return tree.compareStored(node.getKey(idx), node.isKeyRef(idx), key)
+}
+
+// compare the stored form of a key with the input key, in the order of the tree
+func (tree *BTree) compareStored(stored []byte, isRef bool, key []byte) int {
+	if !isRef {
+		return tree.compare(stored, key)
+	}
+	prefix := tree.keyPrefixSize()
+	if !tree.cfg.bytewise {
+		// needs the whole key
+		whole := append(stored[:prefix:prefix], tree.readOverflow(stored[prefix:])...)
+		return tree.compare(whole, key)
+	}
+	head := key[:min(len(key), prefix)]
+	if cmp := bytes.Compare(stored[:prefix], head); cmp != 0 {
+		return cmp
+	}
+	if len(key) <= prefix {
+		return +1 // the input key is a prefix of the stored key
+	}
+	return bytes.Compare(tree.readOverflow(stored[prefix:]), key[prefix:])
+}
+
+// the overflow pages of the value of a leaf KV
+func (tree *BTree) valuePages(node BNode, idx uint16) []uint64 {
+	if node.isValueRef(idx) {
+		return tree.overflowPages(node.getValue(idx))
+	}
+	return nil
+}
+
+// the overflow pages owned by a leaf KV, to be freed when the KV is removed
+func (tree *BTree) kvPages(node BNode, idx uint16) []uint64 {
+	return tree.entryPages(node.getKey(idx), node.keyFlag(idx), node.getValue(idx), node.valueFlag(idx))
+}
+
+// the overflow pages owned by the stored form of a KV
+func (tree *BTree) entryPages(key []byte, kflag uint16, val []byte, vflag uint16) []uint64 {
+	var pages []uint64
+	if vflag != 0 {
+		pages = tree.overflowPages(val)
+	}
+	if kflag != 0 {
+		pages = append(pages, tree.overflowPages(key[tree.keyPrefixSize():])...)
+	}
+	return pages
+}
+
+// deallocate a list of pages
+func (tree *BTree) freePages(pages []uint64) {
+	for _, ptr := range pages {
+		tree.del(ptr)
+	}
+}
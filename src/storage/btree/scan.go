@@ -0,0 +1,133 @@
+package btree
+
+import (
+	"bytes"
+)
+
+// ScanOptions controls the bounds, the order and the size of a range scan.
+// the zero value scans [start, end) in ascending order without a limit.
+type ScanOptions struct {
+	StartExclusive bool // exclude the start key from the range
+	EndInclusive   bool // include the end key in the range
+	Reverse        bool // yield keys in descending order
+	Limit          int  // the maximum number of keys to yield, 0 for no limit
+}
+
+// Scanner yields the key-value pairs of a range scan.
+// it is invalidated by any update to the tree.
+type Scanner struct {
+	iter   *BIter
+	start  []byte // nil for no lower bound
+	end    []byte // nil for no upper bound
+	prefix []byte // only yield keys with the prefix, nil for any key
+	opts   ScanOptions
+	count  int // the number of keys yielded so far
+}
+
+// Scan returns a scanner over the keys between start and end.
+// a nil start or end leaves that side of the range unbounded.
+func (tree *BTree) Scan(start []byte, end []byte, opts ScanOptions) *Scanner {
+	sc := &Scanner{start: start, end: end, opts: opts}
+	if !opts.Reverse {
+		sc.iter = tree.Seek(start)
+		if start != nil && opts.StartExclusive && sc.iter.Valid() &&
+			tree.compare(sc.iter.Key(), start) == 0 {
+			sc.iter.Next()
+		}
+	} else {
+		if end == nil {
+			sc.iter = tree.seekLast()
+		} else {
+			sc.iter = tree.seekLE(end)
+			if !opts.EndInclusive && sc.iter.Valid() &&
+				tree.compare(sc.iter.Key(), end) == 0 {
+				sc.iter.Prev()
+			}
+		}
+	}
+	return sc
+}
+
+// ScanPrefix returns a scanner over the keys that start with the prefix.
+// with a custom comparator the keys with the prefix might not be adjacent,
+// so every key is scanned and filtered.
+func (tree *BTree) ScanPrefix(prefix []byte) *Scanner {
+	if tree.cfg.bytewise {
+		return tree.Scan(prefix, prefixEnd(prefix), ScanOptions{})
+	}
+	sc := tree.Scan(nil, nil, ScanOptions{})
+	sc.prefix = prefix
+	sc.skip()
+	return sc
+}
+
+// move past the keys that are filtered out
+func (sc *Scanner) skip() {
+	for sc.prefix != nil && sc.iter.Valid() && !sc.pastBound(sc.iter.Key()) &&
+		!bytes.HasPrefix(sc.iter.Key(), sc.prefix) {
+		if !sc.opts.Reverse {
+			sc.iter.Next()
+		} else {
+			sc.iter.Prev()
+		}
+	}
+}
+
+// the smallest key that is greater than every key with the prefix.
+// returns nil if there is no such key, i.e. the prefix is all 0xff.
+func prefixEnd(prefix []byte) []byte {
+	end := bytes.Clone(prefix)
+	for len(end) > 0 && end[len(end)-1] == 0xff {
+		end = end[:len(end)-1]
+	}
+	if len(end) == 0 {
+		return nil
+	}
+	end[len(end)-1]++
+	return end
+}
+
+// whether the key is past the far end of the scan
+func (sc *Scanner) pastBound(key []byte) bool {
+	if !sc.opts.Reverse {
+		if sc.end == nil {
+			return false
+		}
+		cmp := sc.iter.tree.compare(key, sc.end)
+		return cmp > 0 || (cmp == 0 && !sc.opts.EndInclusive)
+	}
+	if sc.start == nil {
+		return false
+	}
+	cmp := sc.iter.tree.compare(key, sc.start)
+	return cmp < 0 || (cmp == 0 && sc.opts.StartExclusive)
+}
+
+// whether the scanner points to a key in the range
+func (sc *Scanner) Valid() bool {
+	if sc.opts.Limit > 0 && sc.count >= sc.opts.Limit {
+		return false
+	}
+	return sc.iter.Valid() && !sc.pastBound(sc.iter.Key())
+}
+
+// the current key, the scanner must be valid
+func (sc *Scanner) Key() []byte {
+	return sc.iter.Key()
+}
+
+// the current value, the scanner must be valid
+func (sc *Scanner) Value() []byte {
+	return sc.iter.Value()
+}
+
+// move to the next key in the scan order
+func (sc *Scanner) Next() {
+	if !sc.opts.Reverse {
+		sc.iter.Next()
+	} else {
+		sc.iter.Prev()
+	}
+	sc.count++
+	sc.skip()
+}
@@ -0,0 +1,250 @@
+package btree
+
+import (
+	"encoding/binary"
+
+	"github.com/harish876/scratchdb/src/utils"
+)
+
+/*
+	### Slotted Leaf
+
+	A private leaf that is not yet committed to a page. The slots grow
+	from the start of the buffer and the KVs grow from the end, so an
+	insert or a delete only shifts the slots and the KVs stay in place.
+	The space of removed KVs is reclaimed by compaction, and the leaf is
+	compacted into a BNode before the page is allocated.
+
+	|   slots    | unused |   key-values   |
+	|------------|--------|----------------|
+	| nslots * 4B|        | ... (from end) |
+
+	A KV has the same format as in a BNode, with the overflow flags.
+*/
+
+// the width of a slot, the offset of a KV in the buffer
+const SLOT_SIZE = 4
+
+type slottedLeaf struct {
+	buf     []byte
+	spare   []byte // the scratch buffer for compaction
+	nslots  int
+	top     int // the start of the KVs
+	garbage int // the bytes of the removed KVs
+	key     []byte
+}
+
+// empty the leaf and make room for the size in bytes
+func (sl *slottedLeaf) reset(size int) {
+	if cap(sl.buf) < size {
+		sl.buf = make([]byte, size)
+		sl.spare = make([]byte, size)
+	}
+	sl.buf, sl.spare = sl.buf[:size], sl.spare[:size]
+	sl.nslots, sl.top, sl.garbage = 0, size, 0
+}
+
+// load the KVs of a leaf node
+func (sl *slottedLeaf) load(node BNode) {
+	nkeys := node.nkeys()
+	if len(node.prefix()) > 0 {
+		for i := uint16(0); i < nkeys; i++ {
+			e := nodeEntry(node, i)
+			utils.Assert(sl.insert(sl.nslots, e.key, e.val, e.kflag, e.vflag))
+		}
+		return
+	}
+	// copy the KVs as is and point the slots at them
+	begin, end := node.kvPos(0), node.kvPos(nkeys)
+	sl.top -= end - begin
+	copy(sl.buf[sl.top:], node[begin:end])
+	for i := uint16(0); i < nkeys; i++ {
+		sl.setSlot(int(i), sl.top+node.getOffset(i))
+	}
+	sl.nslots = int(nkeys)
+}
+
+func (sl *slottedLeaf) slot(i int) int {
+	return int(binary.LittleEndian.Uint32(sl.buf[SLOT_SIZE*i:]))
+}
+
+func (sl *slottedLeaf) setSlot(i int, pos int) {
+	binary.LittleEndian.PutUint32(sl.buf[SLOT_SIZE*i:], uint32(pos))
+}
+
+// the lengths of the KV at the position with the overflow flags
+func (sl *slottedLeaf) lens(i int) (uint16, uint16) {
+	pos := sl.slot(i)
+	return binary.LittleEndian.Uint16(sl.buf[pos:]), binary.LittleEndian.Uint16(sl.buf[pos+2:])
+}
+
+// the bytes of the KV at the position
+func (sl *slottedLeaf) kv(i int) []byte {
+	klen, vlen := sl.lens(i)
+	size := 4 + int(klen&^BTREE_LEN_OVERFLOW) + int(vlen&^BTREE_LEN_OVERFLOW)
+	pos := sl.slot(i)
+	return sl.buf[pos : pos+size]
+}
+
+// the stored key and its flag
+func (sl *slottedLeaf) getKey(i int) ([]byte, uint16) {
+	klen, _ := sl.lens(i)
+	n := int(klen &^ BTREE_LEN_OVERFLOW)
+	return sl.kv(i)[4:][:n], klen & BTREE_LEN_OVERFLOW
+}
+
+// the stored value and its flag
+func (sl *slottedLeaf) getValue(i int) ([]byte, uint16) {
+	klen, vlen := sl.lens(i)
+	n := int(klen &^ BTREE_LEN_OVERFLOW)
+	return sl.kv(i)[4+n:], vlen & BTREE_LEN_OVERFLOW
+}
+
+// insert a KV at the position, returns false if there is no room left
+func (sl *slottedLeaf) insert(i int, key []byte, val []byte, kflag, vflag uint16) bool {
+	size := 4 + len(key) + len(val)
+	if sl.top-SLOT_SIZE*(sl.nslots+1) < size {
+		sl.compact()
+		if sl.top-SLOT_SIZE*(sl.nslots+1) < size {
+			return false
+		}
+	}
+	// write the KV below the others
+	sl.top -= size
+	binary.LittleEndian.PutUint16(sl.buf[sl.top:], uint16(len(key))|kflag)
+	binary.LittleEndian.PutUint16(sl.buf[sl.top+2:], uint16(len(val))|vflag)
+	copy(sl.buf[sl.top+4:], key)
+	copy(sl.buf[sl.top+4+len(key):], val)
+	// shift the slots after it
+	copy(sl.buf[SLOT_SIZE*(i+1):], sl.buf[SLOT_SIZE*i:SLOT_SIZE*sl.nslots])
+	sl.setSlot(i, sl.top)
+	sl.nslots++
+	return true
+}
+
+// remove the KV at the position, its space is reclaimed by compaction
+func (sl *slottedLeaf) remove(i int) {
+	sl.garbage += len(sl.kv(i))
+	copy(sl.buf[SLOT_SIZE*i:], sl.buf[SLOT_SIZE*(i+1):SLOT_SIZE*sl.nslots])
+	sl.nslots--
+}
+
+// replace the value of the KV at the position, the key is kept
+func (sl *slottedLeaf) update(i int, val []byte, vflag uint16) bool {
+	key, kflag := sl.getKey(i)
+	sl.key = append(sl.key[:0], key...) // the KV might be moved
+	sl.remove(i)
+	return sl.insert(i, sl.key, val, kflag, vflag)
+}
+
+// move the live KVs to the end of the buffer and drop the garbage
+func (sl *slottedLeaf) compact() {
+	if sl.garbage == 0 {
+		return
+	}
+	top := len(sl.spare)
+	for i := 0; i < sl.nslots; i++ {
+		kv := sl.kv(i)
+		top -= len(kv)
+		copy(sl.spare[top:], kv)
+		sl.setSlot(i, top)
+	}
+	// the slots are kept, only the KVs are swapped in
+	copy(sl.buf[top:], sl.spare[top:])
+	sl.top, sl.garbage = top, 0
+}
+
+// the size of the leaf as a BNode with 2-byte offsets
+func (sl *slottedLeaf) nbytes() int {
+	return HEADER + 10*sl.nslots + len(sl.buf) - sl.top - sl.garbage
+}
+
+// write out the leaf as a BNode of at least the size
+func (sl *slottedLeaf) toNode(size int) BNode {
+	node := newTempNode(max(size, sl.nbytes()))
+	node.setHeader(BNODE_LEAF, uint16(sl.nslots))
+	pos := node.kvPos(0)
+	for i := 0; i < sl.nslots; i++ {
+		kv := sl.kv(i)
+		copy(node[pos:], kv)
+		pos += len(kv)
+		node.setOffset(uint16(i+1), pos-node.kvPos(0))
+	}
+	return node
+}
+
+// the upper bound of the size of a leaf after the updates, with a slot
+// and a BNode link per new KV
+func (tree *BTree) inPlaceBound(node BNode, ops []batchOp) int {
+	size := node.rawBytes()
+	for _, op := range ops {
+		if op.del {
+			continue
+		}
+		klen, vlen := len(op.key), len(op.val)
+		if klen > tree.maxKeySize() {
+			klen = tree.keyPrefixSize() + OVERFLOW_REF_SIZE
+		}
+		if vlen > tree.maxValSize() {
+			vlen = OVERFLOW_REF_SIZE
+		}
+		size += 8 + 2 + SLOT_SIZE + 4 + klen + vlen
+	}
+	return size
+}
+
+// merge the updates into a leaf in place. the result is 1~3 nodes that fit
+// into a page, or false if the result might not fit into 2 pages and the
+// leaf is left to leafApply(). nothing is written before that is decided.
+func leafApplyInPlace(tx *batchTx, node BNode, ops []batchOp) ([]BNode, bool, bool) {
+	tree := tx.tree
+	bound := tree.inPlaceBound(node, ops)
+	if bound > 2*tree.pageSize() {
+		return nil, false, false
+	}
+	sl := &tx.slotted
+	sl.reset(2 * bound)
+	sl.load(node)
+
+	changed := false
+	i := 0
+	for _, op := range ops {
+		// skip the KVs before the key
+		cmp := -1
+		for ; i < sl.nslots; i++ {
+			key, kflag := sl.getKey(i)
+			if cmp = tree.compareStored(key, kflag != 0, op.key); cmp >= 0 {
+				break
+			}
+		}
+		found := i < sl.nslots && cmp == 0
+		switch {
+		case found && op.del:
+			key, kflag := sl.getKey(i)
+			val, vflag := sl.getValue(i)
+			tx.freed = append(tx.freed, tree.entryPages(key, kflag, val, vflag)...)
+			sl.remove(i)
+		case found:
+			if val, vflag := sl.getValue(i); vflag != 0 {
+				tx.freed = append(tx.freed, tree.overflowPages(val)...)
+			}
+			val, vflag := tx.storeValue(op.val)
+			utils.Assert(sl.update(i, val, vflag))
+			i++
+		case op.del:
+			continue // deleting a missing key
+		default:
+			key, kflag := tx.storeKey(op.key)
+			val, vflag := tx.storeValue(op.val)
+			utils.Assert(sl.insert(i, key, val, kflag, vflag))
+			i++
+		}
+		changed = true
+	}
+	if !changed {
+		return nil, false, true
+	}
+	// the node is a full page unless it's split, so it's not copied again
+	nsplit, split := nodeSplit3(tree, sl.toNode(tree.pageSize()))
+	return split[:nsplit], true, true
+}
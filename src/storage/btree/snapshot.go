@@ -0,0 +1,74 @@
+package btree
+
+import (
+	"sync"
+)
+
+// the readers of the roots of a tree, shared by the tree and its snapshots.
+// a page replaced by an update is freed once no snapshot of a root that
+// contains it is left.
+type readers struct {
+	mu       sync.Mutex
+	versions []*version // oldest first, the last one is the current root
+}
+
+// a root that is or was the current one
+type version struct {
+	readers int      // the snapshots of the root not released yet
+	freed   []uint64 // the pages replaced when the root was switched away
+}
+
+// the version of the current root
+func (rs *readers) current() *version {
+	if len(rs.versions) == 0 {
+		rs.versions = append(rs.versions, &version{})
+	}
+	return rs.versions[len(rs.versions)-1]
+}
+
+// a read-only view of the tree as of now, which can be read while the tree
+// is updated by another goroutine. an update is either all in the snapshot
+// or not at all, and the pages of the snapshot are not freed until Release.
+// the tree has a single writer, and it can't be read concurrently itself.
+func (tree *BTree) Snapshot() *BTree {
+	rs := tree.readers
+	rs.mu.Lock()
+	defer rs.mu.Unlock()
+	v := rs.current()
+	v.readers++
+	return &BTree{root: tree.root, cfg: tree.cfg, store: tree.store, readers: rs, pin: v}
+}
+
+// release a snapshot, the slices read from it must not be used after.
+// the pages only it keeps are freed by the next update of the tree.
+func (tree *BTree) Release() {
+	if tree.pin == nil {
+		return
+	}
+	tree.readers.mu.Lock()
+	tree.pin.readers--
+	tree.readers.mu.Unlock()
+	tree.pin = nil
+}
+
+// switch to the new root, the pages replaced by the update are freed now,
+// or after the last snapshot of an older root is released
+func (tree *BTree) publish(root uint64) {
+	rs := tree.readers
+	rs.mu.Lock()
+	cur := rs.current()
+	cur.freed = append(cur.freed, tree.freed...)
+	tree.freed = nil
+	tree.root = root
+	rs.versions = append(rs.versions, &version{})
+	// the pages replaced after a root are still in the older roots
+	pages := []uint64{}
+	for len(rs.versions) > 1 && rs.versions[0].readers == 0 {
+		pages = append(pages, rs.versions[0].freed...)
+		rs.versions = rs.versions[1:]
+	}
+	rs.mu.Unlock()
+	for _, ptr := range pages {
+		tree.store.Free(ptr)
+	}
+}
@@ -0,0 +1,183 @@
+package btree
+
+import (
+	"encoding/binary"
+	"fmt"
+	"io"
+	"strings"
+)
+
+// the number of buckets of Stats.FillHistogram, 10% each
+const STATS_FILL_BUCKETS = 10
+
+// the bytes of a key shown by DumpText and DumpDOT, longer keys are cut
+const DUMP_KEY_SIZE = 16
+
+// Stats describes the shape of a tree
+type Stats struct {
+	Height        int // the number of levels, 0 for an empty tree
+	InternalPages int
+	LeafPages     int
+	OverflowPages int    // the pages of large keys and values
+	Keys          uint64 // the sentinel key not counted
+	KeyBytes      uint64 // the whole keys, including the overflow tails
+	ValueBytes    uint64 // the whole values, including the overflow pages
+	// the number of internal and leaf pages by nbytes() / page size,
+	// the last bucket includes full pages
+	FillHistogram [STATS_FILL_BUCKETS]int
+}
+
+// walk the whole tree and collect the statistics
+func (tree *BTree) Stats() (Stats, error) {
+	stats := Stats{}
+	if tree.root == 0 {
+		return stats, nil
+	}
+	err := tree.walk(tree.root, 1, func(ptr uint64, node BNode, depth int) {
+		stats.Height = max(stats.Height, depth)
+		fill := node.nbytes() * STATS_FILL_BUCKETS / tree.pageSize()
+		stats.FillHistogram[min(fill, STATS_FILL_BUCKETS-1)]++
+		if node.btype() == BNODE_NODE {
+			stats.InternalPages++
+			return
+		}
+		stats.LeafPages++
+		stats.Keys += nodeCount(node)
+		for i := uint16(0); i < node.nkeys(); i++ {
+			key := node.getKey(i)
+			stats.KeyBytes += uint64(len(key))
+			if node.isKeyRef(i) {
+				tail := key[tree.keyPrefixSize():]
+				stats.KeyBytes += uint64(overflowSize(tail)) - uint64(len(tail))
+			}
+			if val := node.getValue(i); node.isValueRef(i) {
+				stats.ValueBytes += uint64(overflowSize(val))
+			} else {
+				stats.ValueBytes += uint64(len(val))
+			}
+			stats.OverflowPages += len(tree.kvPages(node, i))
+		}
+	})
+	return stats, err
+}
+
+// the length of the data of an overflow chain
+func overflowSize(ref []byte) int {
+	return int(binary.LittleEndian.Uint32(ref[0:4]))
+}
+
+// visit every node of a subtree, parents first
+func (tree *BTree) walk(ptr uint64, depth int, visit func(ptr uint64, node BNode, depth int)) error {
+	node := tree.get(ptr)
+	if err := checkNode(node); err != nil {
+		return fmt.Errorf("page %d: %w", ptr, err)
+	}
+	visit(ptr, node, depth)
+	if node.btype() == BNODE_NODE {
+		for i := uint16(0); i < node.nkeys(); i++ {
+			if err := tree.walk(node.getPtr(i), depth+1, visit); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// every page of the tree, including the overflow pages
+func (tree *BTree) reachable() (map[uint64]bool, error) {
+	pages := map[uint64]bool{}
+	if tree.root == 0 {
+		return pages, nil
+	}
+	err := tree.walk(tree.root, 1, func(ptr uint64, node BNode, depth int) {
+		pages[ptr] = true
+		if node.btype() == BNODE_LEAF {
+			for i := uint16(0); i < node.nkeys(); i++ {
+				for _, page := range tree.kvPages(node, i) {
+					pages[page] = true
+				}
+			}
+		}
+	})
+	return pages, err
+}
+
+// a short printable form of a stored key
+func dumpKey(node BNode, idx uint16) string {
+	key := node.getKey(idx)
+	suffix := ""
+	if node.isKeyRef(idx) || len(key) > DUMP_KEY_SIZE {
+		key, suffix = key[:min(len(key), DUMP_KEY_SIZE)], "..."
+	}
+	return fmt.Sprintf("%q%s", key, suffix)
+}
+
+// the type, the number of keys and the fill of a node
+func (tree *BTree) dumpHeader(ptr uint64, node BNode) string {
+	name := "leaf"
+	if node.btype() == BNODE_NODE {
+		name = "node"
+	}
+	fill := node.nbytes() * 100 / tree.pageSize()
+	return fmt.Sprintf("%s %d: %d keys, %d%% full", name, ptr, node.nkeys(), fill)
+}
+
+// write every node as indented text, an internal node lists its separators
+// and kid pointers, a leaf lists its keys
+func (tree *BTree) DumpText(w io.Writer) error {
+	if tree.root == 0 {
+		_, err := fmt.Fprintln(w, "empty")
+		return err
+	}
+	var werr error
+	err := tree.walk(tree.root, 1, func(ptr uint64, node BNode, depth int) {
+		indent := strings.Repeat("  ", depth-1)
+		lines := []string{indent + tree.dumpHeader(ptr, node)}
+		for i := uint16(0); i < node.nkeys(); i++ {
+			line := indent + "  " + dumpKey(node, i)
+			if node.btype() == BNODE_NODE {
+				line += fmt.Sprintf(" -> %d", node.getPtr(i))
+			}
+			lines = append(lines, line)
+		}
+		if werr == nil {
+			_, werr = fmt.Fprintln(w, strings.Join(lines, "\n"))
+		}
+	})
+	if err != nil {
+		return err
+	}
+	return werr
+}
+
+// write the tree as a Graphviz digraph, a node per page and an edge per kid link
+func (tree *BTree) DumpDOT(w io.Writer) error {
+	out := []string{"digraph btree {", "\tnode [shape=box, fontname=monospace];"}
+	if tree.root != 0 {
+		err := tree.walk(tree.root, 1, func(ptr uint64, node BNode, depth int) {
+			label := []string{tree.dumpHeader(ptr, node)}
+			for i := uint16(0); i < node.nkeys(); i++ {
+				label = append(label, dumpKey(node, i))
+			}
+			out = append(out, fmt.Sprintf("\tn%d [label=%s];", ptr, dotQuote(strings.Join(label, "\n"))))
+			if node.btype() == BNODE_NODE {
+				for i := uint16(0); i < node.nkeys(); i++ {
+					out = append(out, fmt.Sprintf("\tn%d -> n%d;", ptr, node.getPtr(i)))
+				}
+			}
+		})
+		if err != nil {
+			return err
+		}
+	}
+	out = append(out, "}")
+	_, err := fmt.Fprintln(w, strings.Join(out, "\n"))
+	return err
+}
+
+// a DOT string, the lines are left aligned
+func dotQuote(s string) string {
+	s = strings.ReplaceAll(s, `\`, `\\`)
+	s = strings.ReplaceAll(s, `"`, `\"`)
+	return `"` + strings.ReplaceAll(s, "\n", `\l`) + `\l"`
+}
@@ -0,0 +1,130 @@
+//go:build unix
+
+package pager
+
+import (
+	"encoding/binary"
+	"fmt"
+)
+
+/*
+	### Free List
+
+	The free pages are kept in a linked list of pages, the meta page
+	points to the first one. It's rewritten by each Commit from the
+	pages that are known to be free, so that the old list stays valid
+	until the new one is on the disk.
+
+	| type | count |  next  |    pointers    | unused |
+	|------|-------|--------|----------------|--------|
+	|  2B  |   2B  |   8B   |  count * 8B    |        |
+*/
+
+// the page type of a free list page, after the node types of the tree
+const BNODE_FREE_LIST = 4
+
+const FREE_LIST_HEADER = 4 + 8
+
+type freeList struct {
+	ready   []uint64        // can be reused now
+	pending []uint64        // freed since the last sync, still part of the synced tree
+	pages   []uint64        // the pages of the synced list
+	next    []uint64        // the pages of the list written by the current sync
+	fresh   map[uint64]bool // allocated since the last sync, reusable once freed
+}
+
+// the number of pointers in a list page
+func (fl *freeList) capacity(pageSize int) int {
+	return (pageSize - FREE_LIST_HEADER) / 8
+}
+
+// read the synced list
+func (fl *freeList) load(p *FilePager, head uint64) error {
+	fl.fresh = map[uint64]bool{}
+	for ptr := head; ptr != 0; {
+		if ptr >= p.npages || len(fl.pages) >= int(p.npages) {
+			return fmt.Errorf("%w: bad free list page %d", ErrBadFile, ptr)
+		}
+		page := p.Get(ptr)
+		count := int(binary.LittleEndian.Uint16(page[2:4]))
+		if binary.LittleEndian.Uint16(page[0:2]) != BNODE_FREE_LIST || count > fl.capacity(p.pageSize) {
+			return fmt.Errorf("%w: bad free list page %d", ErrBadFile, ptr)
+		}
+		for i := 0; i < count; i++ {
+			fl.ready = append(fl.ready, binary.LittleEndian.Uint64(page[FREE_LIST_HEADER+8*i:]))
+		}
+		fl.pages = append(fl.pages, ptr)
+		ptr = binary.LittleEndian.Uint64(page[4:12])
+	}
+	return nil
+}
+
+// take a page that can be reused
+func (fl *freeList) pop() (uint64, bool) {
+	if len(fl.ready) == 0 {
+		return 0, false
+	}
+	ptr := fl.ready[len(fl.ready)-1]
+	fl.ready = fl.ready[:len(fl.ready)-1]
+	return ptr, true
+}
+
+// add a freed page, a page that is not synced yet is reusable at once
+func (fl *freeList) push(ptr uint64) {
+	if fl.fresh[ptr] {
+		delete(fl.fresh, ptr)
+		fl.ready = append(fl.ready, ptr)
+	} else {
+		fl.pending = append(fl.pending, ptr)
+	}
+}
+
+// write the list of every free page after the sync, including the pages of
+// the old list. the pages of the new list are free pages or new pages,
+// never the ones of the synced tree. returns the first page.
+func (fl *freeList) save(p *FilePager) (uint64, error) {
+	per := fl.capacity(p.pageSize)
+	// the number of list pages, some of them are taken from the list
+	n := len(fl.ready) + len(fl.pending) + len(fl.pages)
+	k := 0
+	for k*per < n-min(k, len(fl.ready)) {
+		k++
+	}
+	fl.next = fl.next[:0]
+	for i := 0; i < k; i++ {
+		ptr, ok := fl.pop()
+		if !ok {
+			ptr = p.npages
+			p.npages++
+		}
+		fl.next = append(fl.next, ptr)
+	}
+	items := append(append(append([]uint64{}, fl.ready...), fl.pending...), fl.pages...)
+	for i, ptr := range fl.next {
+		page := make([]byte, p.pageSize)
+		chunk := items[min(i*per, len(items)):min((i+1)*per, len(items))]
+		binary.LittleEndian.PutUint16(page[0:2], BNODE_FREE_LIST)
+		binary.LittleEndian.PutUint16(page[2:4], uint16(len(chunk)))
+		if i+1 < len(fl.next) {
+			binary.LittleEndian.PutUint64(page[4:12], fl.next[i+1])
+		}
+		for j, item := range chunk {
+			binary.LittleEndian.PutUint64(page[FREE_LIST_HEADER+8*j:], item)
+		}
+		if err := p.write(ptr, page); err != nil {
+			return 0, err
+		}
+	}
+	if k == 0 {
+		return 0, nil
+	}
+	return fl.next[0], nil
+}
+
+// the new list is on the disk, every page on it can be reused
+func (fl *freeList) synced() {
+	fl.ready = append(append(fl.ready, fl.pending...), fl.pages...)
+	fl.pending = nil
+	fl.pages = append([]uint64{}, fl.next...)
+	fl.fresh = map[uint64]bool{}
+}
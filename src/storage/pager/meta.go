@@ -0,0 +1,72 @@
+//go:build unix
+
+package pager
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+)
+
+/*
+	### Meta Page
+
+	Page 0 describes the committed state of the file. A commit writes
+	the new pages first, then flips the meta page, with an fsync after
+	each step, so a crash leaves either the old tree or the new one.
+
+	| magic | version | page size | root | free list | pages | unused |
+	|-------|---------|-----------|------|-----------|-------|--------|
+	|  16B  |   4B    |    4B     |  8B  |    8B     |  8B   |        |
+*/
+
+const META_MAGIC = "ScratchDB pager\x00"
+
+const META_VERSION = 1
+
+const META_SIZE = 16 + 4 + 4 + 8 + 8 + 8
+
+type meta struct {
+	version  uint32
+	pageSize uint32
+	root     uint64 // the root of the tree, 0 for an empty tree
+	free     uint64 // the first page of the free list
+	npages   uint64 // the pages in use, the file can be longer after a crash
+}
+
+func (m *meta) encode(page []byte) {
+	copy(page, META_MAGIC)
+	binary.LittleEndian.PutUint32(page[16:], m.version)
+	binary.LittleEndian.PutUint32(page[20:], m.pageSize)
+	binary.LittleEndian.PutUint64(page[24:], m.root)
+	binary.LittleEndian.PutUint64(page[32:], m.free)
+	binary.LittleEndian.PutUint64(page[40:], m.npages)
+}
+
+func (m *meta) decode(data []byte) error {
+	if len(data) < META_SIZE || !bytes.Equal(data[:16], []byte(META_MAGIC)) {
+		return fmt.Errorf("%w: not a pager file", ErrBadFile)
+	}
+	m.version = binary.LittleEndian.Uint32(data[16:])
+	m.pageSize = binary.LittleEndian.Uint32(data[20:])
+	m.root = binary.LittleEndian.Uint64(data[24:])
+	m.free = binary.LittleEndian.Uint64(data[32:])
+	m.npages = binary.LittleEndian.Uint64(data[40:])
+	if m.version != META_VERSION {
+		return fmt.Errorf("%w: format version %d", ErrBadFile, m.version)
+	}
+	if m.npages == 0 || m.root >= m.npages || m.free >= m.npages {
+		return fmt.Errorf("%w: bad meta page", ErrBadFile)
+	}
+	return nil
+}
+
+// write the meta page and wait for the disk
+func (p *FilePager) writeMeta(m *meta) error {
+	page := make([]byte, p.pageSize)
+	m.encode(page)
+	if _, err := p.fp.WriteAt(page, 0); err != nil {
+		return err
+	}
+	return p.fp.Sync()
+}
@@ -0,0 +1,282 @@
+//go:build unix
+
+package pager
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"sync"
+	"syscall"
+
+	"github.com/harish876/scratchdb/src/storage/btree"
+)
+
+/*
+	### File Layout
+
+	| page 0 | page 1 | page 2 | ... |
+	|--------|--------|--------|-----|
+
+	Page number × page size is the file offset. Page 0 is the meta
+	page, a page number of 0 is the null pointer of the tree.
+
+	Pages are read through read-only mmap chunks that cover the file,
+	and written with pwrite. The chunks grow by doubling the mapped
+	size, the old ones stay valid so that read pages never move.
+*/
+
+// the size of the first mmap chunk, it's doubled as the file grows
+var mmapInitSize = 64 << 20
+
+var ErrBadFile = errors.New("pager: bad file")
+
+// Options configures a pager, the zero value selects the defaults
+type Options struct {
+	// the size of a page, 0 is btree.BTREE_PAGE_SIZE for a new file and
+	// the size of an existing file. it must be the page size of the tree.
+	PageSize int
+	// open the file read-only, the trees on it can't be updated
+	ReadOnly bool
+}
+
+// FilePager is a btree.PageStore that keeps the pages in a single file.
+// pages can be read while it's updated.
+type FilePager struct {
+	mu       sync.RWMutex
+	fp       *os.File
+	pageSize int
+	readOnly bool
+	root     uint64 // the committed root
+	npages   uint64 // the number of pages in use
+	mmap     struct {
+		total  int      // the mapped size, can be larger than the file
+		chunks [][]byte // multiple mmaps, can be non-continuous
+	}
+	err       error             // the first write error, reported by Commit
+	unwritten map[uint64][]byte // the pages allocated after a write error
+	free      freeList
+}
+
+// open or create a file of pages
+func Open(path string, opts ...Options) (*FilePager, error) {
+	opt := append(opts, Options{})[0]
+	flag := os.O_RDWR | os.O_CREATE
+	if opt.ReadOnly {
+		flag = os.O_RDONLY
+	}
+	fp, err := os.OpenFile(path, flag, 0o644)
+	if err != nil {
+		return nil, err
+	}
+	p := &FilePager{fp: fp, pageSize: opt.PageSize, readOnly: opt.ReadOnly}
+	if err := p.init(); err != nil {
+		p.Close()
+		return nil, err
+	}
+	return p, nil
+}
+
+// read the meta page, a new file gets one
+func (p *FilePager) init() error {
+	fi, err := p.fp.Stat()
+	if err != nil {
+		return err
+	}
+	m := meta{}
+	if fi.Size() == 0 {
+		if p.readOnly {
+			return fmt.Errorf("%w: empty file", ErrBadFile)
+		}
+		if p.pageSize == 0 {
+			p.pageSize = btree.BTREE_PAGE_SIZE
+		}
+		m = meta{version: META_VERSION, pageSize: uint32(p.pageSize), npages: 1}
+		if err := p.writeMeta(&m); err != nil {
+			return err
+		}
+	} else {
+		data := make([]byte, META_SIZE)
+		if _, err := p.fp.ReadAt(data, 0); err != nil {
+			return fmt.Errorf("%w: %w", ErrBadFile, err)
+		}
+		if err := m.decode(data); err != nil {
+			return err
+		}
+		if p.pageSize != 0 && p.pageSize != int(m.pageSize) {
+			return fmt.Errorf("%w: page size %d, not %d", ErrBadFile, m.pageSize, p.pageSize)
+		}
+		p.pageSize = int(m.pageSize)
+		if fi.Size() < int64(m.npages)*int64(p.pageSize) {
+			return fmt.Errorf("%w: the file is shorter than %d pages", ErrBadFile, m.npages)
+		}
+	}
+	p.root, p.npages = m.root, m.npages
+	if err := p.extendMmap(int(p.npages) * p.pageSize); err != nil {
+		return err
+	}
+	return p.free.load(p, m.free)
+}
+
+// map more of the file so that it covers the size
+func (p *FilePager) extendMmap(size int) error {
+	if size <= p.mmap.total {
+		return nil
+	}
+	alloc := max(p.mmap.total, mmapInitSize)
+	for p.mmap.total+alloc < size {
+		alloc *= 2 // still not enough?
+	}
+	chunk, err := syscall.Mmap(
+		int(p.fp.Fd()), int64(p.mmap.total), alloc,
+		syscall.PROT_READ, syscall.MAP_SHARED,
+	)
+	if err != nil {
+		return fmt.Errorf("mmap: %w", err)
+	}
+	p.mmap.total += alloc
+	p.mmap.chunks = append(p.mmap.chunks, chunk)
+	return nil
+}
+
+// read a page through the mmap, the page must not be modified
+func (p *FilePager) Get(ptr uint64) []byte {
+	p.mu.RLock()
+	defer p.mu.RUnlock()
+	if ptr == 0 || ptr >= p.npages {
+		panic(fmt.Errorf("%w: page %d is out of the file", btree.ErrCorruptPage, ptr))
+	}
+	if page, ok := p.unwritten[ptr]; ok {
+		return page
+	}
+	start := uint64(0)
+	for _, chunk := range p.mmap.chunks {
+		end := start + uint64(len(chunk))/uint64(p.pageSize)
+		if ptr < end {
+			offset := uint64(p.pageSize) * (ptr - start)
+			return chunk[offset : offset+uint64(p.pageSize)]
+		}
+		start = end
+	}
+	panic("unreachable")
+}
+
+// write a page to a free page, or append it to the file with pwrite.
+// after a write error, the pages are kept in memory so that the tree can
+// still be read, and the error is returned by Commit.
+func (p *FilePager) Allocate(page []byte) uint64 {
+	if p.readOnly {
+		panic(btree.ErrReadOnly)
+	}
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	ptr, ok := p.free.pop()
+	if !ok {
+		ptr = p.npages
+		p.npages++
+	}
+	p.free.fresh[ptr] = true
+	if p.err == nil {
+		p.err = p.write(ptr, page)
+	}
+	if p.err != nil {
+		if p.unwritten == nil {
+			p.unwritten = map[uint64][]byte{}
+		}
+		p.unwritten[ptr] = page
+	}
+	return ptr
+}
+
+// write a page at its offset and map it
+func (p *FilePager) write(ptr uint64, page []byte) error {
+	if len(page) != p.pageSize {
+		return fmt.Errorf("%w: page of %d bytes", ErrBadFile, len(page))
+	}
+	if _, err := p.fp.WriteAt(page, int64(ptr)*int64(p.pageSize)); err != nil {
+		return err
+	}
+	return p.extendMmap(int(ptr+1) * p.pageSize)
+}
+
+// put a page on the free list, it's reused once it's no longer part of
+// the committed tree
+func (p *FilePager) Free(ptr uint64) {
+	if p.readOnly {
+		panic(btree.ErrReadOnly)
+	}
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.free.push(ptr)
+}
+
+func (p *FilePager) ReadOnly() bool {
+	return p.readOnly
+}
+
+// the root of the tree as of the last commit
+func (p *FilePager) Root() uint64 {
+	p.mu.RLock()
+	defer p.mu.RUnlock()
+	return p.root
+}
+
+// the number of pages in use, including the meta page
+func (p *FilePager) Pages() uint64 {
+	p.mu.RLock()
+	defer p.mu.RUnlock()
+	return p.npages
+}
+
+// the number of pages on the free list
+func (p *FilePager) FreePages() int {
+	p.mu.RLock()
+	defer p.mu.RUnlock()
+	return len(p.free.ready) + len(p.free.pending)
+}
+
+// make the tree with the root durable, the pages freed before are
+// reused after it. the new pages and the free list are written first, then
+// the meta page is switched to the new root. the file is left with the
+// old root if an error is returned.
+func (p *FilePager) Commit(root uint64) error {
+	if p.readOnly {
+		return btree.ErrReadOnly
+	}
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.err != nil {
+		return p.err
+	}
+	head, err := p.free.save(p)
+	if err != nil {
+		p.err = err
+		return err
+	}
+	if err := p.fp.Sync(); err != nil {
+		p.err = err
+		return err
+	}
+	// flip the root once the pages are on the disk
+	m := meta{version: META_VERSION, pageSize: uint32(p.pageSize), root: root, free: head, npages: p.npages}
+	if err := p.writeMeta(&m); err != nil {
+		p.err = err
+		return err
+	}
+	p.root = root
+	p.free.synced()
+	return nil
+}
+
+// unmap and close the file
+func (p *FilePager) Close() error {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	for _, chunk := range p.mmap.chunks {
+		if err := syscall.Munmap(chunk); err != nil {
+			return err
+		}
+	}
+	p.mmap.chunks, p.mmap.total = nil, 0
+	return p.fp.Close()
+}
@@ -0,0 +1,235 @@
+//go:build unix
+
+package pager
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/harish876/scratchdb/src/storage/btree"
+	"github.com/harish876/scratchdb/src/utils"
+)
+
+func TestFilePager(t *testing.T) {
+	// small chunks, so that the mmap grows a few times
+	defer func(size int) { mmapInitSize = size }(mmapInitSize)
+	mmapInitSize = 64 << 10
+
+	path := filepath.Join(t.TempDir(), "pages.db")
+	p, err := Open(path)
+	utils.Assert(err == nil, "Open should create the file")
+	utils.Assert(p.Pages() == 1, "A new file has the meta page")
+
+	page := func(i int) []byte {
+		data := make([]byte, btree.BTREE_PAGE_SIZE)
+		copy(data, fmt.Sprintf("page %d", i))
+		return data
+	}
+	for i := 1; i <= 200; i++ {
+		utils.Assert(p.Allocate(page(i)) == uint64(i), "Pages should be appended to the file")
+	}
+	utils.Assert(len(p.mmap.chunks) > 1, "The mmap should grow with the file")
+	for i := 1; i <= 200; i++ {
+		utils.Assert(bytes.Equal(p.Get(uint64(i)), page(i)), fmt.Sprintf("Page %d should be read back", i))
+	}
+	utils.Assert(p.Commit(0) == nil && p.Close() == nil, "Commit and Close should succeed")
+	fi, _ := os.Stat(path)
+	utils.Assert(fi.Size() == 201*btree.BTREE_PAGE_SIZE, "Page number × page size is the offset")
+
+	// the pages are there after reopening
+	p, err = Open(path, Options{ReadOnly: true})
+	utils.Assert(err == nil && p.Pages() == 201, "Open should find the pages")
+	utils.Assert(bytes.Equal(p.Get(123), page(123)), "Pages should persist")
+	utils.Assert(p.ReadOnly(), "The pager should be read-only")
+	p.Close()
+
+	// the page size comes from the meta page
+	_, err = Open(path, Options{PageSize: 2 * btree.BTREE_PAGE_SIZE})
+	utils.Assert(errors.Is(err, ErrBadFile), "A different page size should be rejected")
+	data, _ := os.ReadFile(path)
+	os.WriteFile(path, data[:100*btree.BTREE_PAGE_SIZE], 0o644)
+	_, err = Open(path)
+	utils.Assert(errors.Is(err, ErrBadFile), "A file shorter than the meta page says should be rejected")
+
+	// bad files
+	os.WriteFile(path, make([]byte, 100), 0o644)
+	_, err = Open(path)
+	utils.Assert(errors.Is(err, ErrBadFile), "A file without the magic should be rejected")
+	bad := append([]byte{}, data...)
+	bad[16] = META_VERSION + 1
+	os.WriteFile(path, bad, 0o644)
+	_, err = Open(path)
+	utils.Assert(errors.Is(err, ErrBadFile), "An unknown format version should be rejected")
+	os.WriteFile(path, nil, 0o644)
+	_, err = Open(path, Options{ReadOnly: true})
+	utils.Assert(errors.Is(err, ErrBadFile), "An empty file can't be opened read-only")
+	_, err = Open(filepath.Join(t.TempDir(), "missing.db"), Options{ReadOnly: true})
+	utils.Assert(err != nil, "A missing file can't be opened read-only")
+}
+
+func TestFilePagerTree(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "tree.db")
+	p, err := Open(path)
+	utils.Assert(err == nil, "Open should succeed")
+	tree, err := btree.New(p)
+	utils.Assert(err == nil, "New should succeed")
+	b := &btree.Batch{}
+	for i := 0; i < 20000; i++ {
+		b.Put([]byte(fmt.Sprintf("key%08d", i)), []byte(fmt.Sprintf("val%d", i)))
+	}
+	utils.Assert(tree.Apply(b) == nil, "Apply should succeed")
+	for i := 0; i < 1000; i++ {
+		utils.Assert(tree.Insert([]byte(fmt.Sprintf("key%08d", i*7)), []byte("updated")) == nil, "Insert should succeed")
+	}
+	utils.Assert(p.Commit(tree.Root()) == nil && p.Close() == nil, "Commit and Close should succeed")
+
+	// reopen the tree from the committed root
+	p, err = Open(path, Options{ReadOnly: true})
+	utils.Assert(err == nil, "Open should succeed")
+	defer p.Close()
+	tree, err = btree.Open(p, p.Root())
+	utils.Assert(err == nil && tree.Check() == nil, "The reopened tree should be valid")
+	for i := 0; i < 20000; i++ {
+		val, ok := tree.Get([]byte(fmt.Sprintf("key%08d", i)))
+		want := fmt.Sprintf("val%d", i)
+		if i%7 == 0 && i/7 < 1000 {
+			want = "updated"
+		}
+		utils.Assert(ok && string(val) == want, "The keys should persist")
+	}
+	utils.Assert(tree.Insert([]byte("new"), []byte("x")) == btree.ErrReadOnly, "A read-only file can't be updated")
+}
+
+func TestFilePagerFreeList(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "tree.db")
+	p, err := Open(path)
+	utils.Assert(err == nil, "Open should succeed")
+	tree, _ := btree.New(p)
+	update := func(round int) {
+		for i := 0; i < 2000; i++ {
+			key := []byte(fmt.Sprintf("key%06d", (i*7919+round)%5000))
+			utils.Assert(tree.Insert(key, []byte(fmt.Sprintf("val%d", round))) == nil, "Insert should succeed")
+		}
+		utils.Assert(p.Commit(tree.Root()) == nil, "Commit should succeed")
+	}
+	for round := 0; round < 10; round++ {
+		update(round)
+	}
+	// the file stops growing once the freed pages are reused
+	size := p.Pages()
+	for round := 10; round < 30; round++ {
+		update(round)
+	}
+	utils.Assert(p.Pages() <= size*21/20, fmt.Sprintf("The file should not keep growing: %d -> %d pages", size, p.Pages()))
+	utils.Assert(p.FreePages() > 0, "Freed pages should be on the free list")
+
+	// every page is either in the tree, on the free list, or one of its pages
+	free := p.FreePages()
+	listPages := len(p.free.pages)
+	utils.Assert(p.Close() == nil, "Close should succeed")
+	p, err = Open(path)
+	utils.Assert(err == nil && p.FreePages() == free, "The free list should persist")
+	tree, _ = btree.Open(p, p.Root())
+	utils.Assert(tree.Check() == nil, "The tree should be intact")
+	stats, _ := tree.Stats()
+	used := stats.InternalPages + stats.LeafPages + stats.OverflowPages
+	utils.Assert(used+free+listPages+1 == int(p.Pages()), fmt.Sprintf("Pages should not leak: %d+%d+%d+1 != %d", used, free, listPages, p.Pages()))
+
+	// reused pages come from the free list
+	update(30)
+	utils.Assert(p.Close() == nil, "Close should succeed")
+}
+
+func TestFilePagerCrash(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "tree.db")
+	p, _ := Open(path)
+	tree, _ := btree.New(p)
+	for i := 0; i < 5000; i++ {
+		tree.Insert([]byte(fmt.Sprintf("key%06d", i)), []byte("old"))
+	}
+	utils.Assert(p.Commit(tree.Root()) == nil, "Commit should succeed")
+
+	// the updates are written to the free pages and the end of the file,
+	// but the meta page still points to the old root
+	for round := 0; round < 3; round++ {
+		for i := 0; i < 5000; i += 3 {
+			tree.Insert([]byte(fmt.Sprintf("key%06d", i)), []byte("new"))
+		}
+		tree.Delete([]byte(fmt.Sprintf("key%06d", round)))
+	}
+	utils.Assert(tree.Check() == nil, "The new tree should be valid")
+	utils.Assert(p.Close() == nil, "Close should succeed")
+
+	// garbage after the committed pages is ignored
+	fp, _ := os.OpenFile(path, os.O_WRONLY|os.O_APPEND, 0o644)
+	fp.Write(bytes.Repeat([]byte{0xff}, 1000))
+	fp.Close()
+
+	p, err := Open(path)
+	utils.Assert(err == nil, "Open should ignore the uncommitted pages")
+	tree, _ = btree.Open(p, p.Root())
+	utils.Assert(tree.Check() == nil, "The old tree should be intact")
+	for i := 0; i < 5000; i++ {
+		val, ok := tree.Get([]byte(fmt.Sprintf("key%06d", i)))
+		utils.Assert(ok && string(val) == "old", "The old tree should be seen after a crash")
+	}
+
+	// the file is usable again, and a commit switches to the new tree
+	utils.Assert(tree.Insert([]byte("key999999"), []byte("new")) == nil, "Insert should succeed")
+	utils.Assert(p.Commit(tree.Root()) == nil && p.Close() == nil, "Commit and Close should succeed")
+	p, _ = Open(path, Options{ReadOnly: true})
+	defer p.Close()
+	tree, _ = btree.Open(p, p.Root())
+	val, ok := tree.Get([]byte("key999999"))
+	utils.Assert(ok && string(val) == "new" && tree.Check() == nil, "The committed tree should be seen")
+	utils.Assert(p.Commit(p.Root()) == btree.ErrReadOnly, "A read-only file can't be committed")
+}
+
+func TestFilePagerSnapshot(t *testing.T) {
+	p, err := Open(filepath.Join(t.TempDir(), "tree.db"))
+	utils.Assert(err == nil, "Open should succeed")
+	defer p.Close()
+	tree, _ := btree.New(p)
+	b := &btree.Batch{}
+	apply := func(round int) {
+		b.Reset()
+		for i := 0; i < 300; i++ {
+			b.Put([]byte(fmt.Sprintf("key%06d", i)), []byte(fmt.Sprintf("val%d", round)))
+		}
+		utils.Assert(tree.Apply(b) == nil && p.Commit(tree.Root()) == nil, "Apply and Commit should succeed")
+	}
+	apply(0)
+
+	// readers of snapshots while the freed pages are reused
+	done, errs := make(chan struct{}), make(chan error)
+	go func() {
+		var err error
+		for err == nil {
+			select {
+			case <-done:
+				errs <- nil
+				return
+			default:
+			}
+			snap := tree.Snapshot()
+			first, _ := snap.Get([]byte("key000000"))
+			last, _ := snap.Get([]byte("key000299"))
+			if !bytes.Equal(first, last) {
+				err = fmt.Errorf("%s and %s in one snapshot", first, last)
+			}
+			snap.Release()
+		}
+		<-done
+		errs <- err
+	}()
+	for round := 1; round <= 100; round++ {
+		apply(round)
+	}
+	close(done)
+	err = <-errs
+	utils.Assert(err == nil, fmt.Sprint("A snapshot should see a whole batch: ", err))
+}